@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	cni "github.com/containerd/go-cni"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// shapeDuration is how long traffic is sent in each direction to
+	// measure the throughput.
+	shapeDuration = time.Second
+	// minBurst is the smallest burst in bits, tbf needs at least an MTU.
+	minBurst = 64 * 1500 * 8
+)
+
+// bandwidthLimits are the limits in bits per second and bursts in bits the
+// bandwidth plugin takes as runtime config.
+type bandwidthLimits struct {
+	IngressRate  uint64 `json:"ingressRate"`
+	IngressBurst uint64 `json:"ingressBurst"`
+	EgressRate   uint64 `json:"egressRate"`
+	EgressBurst  uint64 `json:"egressBurst"`
+}
+
+// mbitToBits converts Mbit/s to bits per second.
+func mbitToBits(mbit int) uint64 {
+	return uint64(mbit) * 1000 * 1000
+}
+
+// newBandwidthLimits limits both directions to rate bits per second, with a
+// burst of 20ms worth of traffic.
+func newBandwidthLimits(rate uint64) bandwidthLimits {
+	burst := rate / 50
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return bandwidthLimits{
+		IngressRate:  rate,
+		IngressBurst: burst,
+		EgressRate:   rate,
+		EgressBurst:  burst,
+	}
+}
+
+// bandwidthResult is what the traffic shaping check found. Rates are in bits
+// per second.
+type bandwidthResult struct {
+	HostVeth string `json:"hostVeth"`
+	IFB      string `json:"ifb,omitempty"`
+	// IngressQdisc and EgressQdisc are the rates of the tbf qdiscs on the
+	// host veth and the ifb device.
+	IngressQdisc uint64 `json:"ingressQdisc"`
+	EgressQdisc  uint64 `json:"egressQdisc"`
+	// Ingress is the throughput from the host to the pod, Egress from the
+	// pod to the host.
+	Ingress float64 `json:"ingress"`
+	Egress  float64 `json:"egress"`
+}
+
+// bandwidthStats holds the ADD and DEL latencies and throughput with a rate
+// limit.
+type bandwidthStats struct {
+	rate     uint64
+	add      *histogram
+	del      *histogram
+	failures int
+	ingress  []float64
+	egress   []float64
+}
+
+// chainsBandwidth reports whether the configuration of a plugin has the
+// bandwidth plugin in its chain.
+func (b *benchmarkCNI) chainsBandwidth(plugin string) bool {
+	types, err := b.pluginTypes(plugin)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if t == "bandwidth" {
+			return true
+		}
+	}
+	return false
+}
+
+// runBandwidth runs the traffic shaping benchmark for every plugin chaining
+// bandwidth. For each rate in Mbit/s it measures -iterations ADD and DEL
+// cycles of a pod limited to that rate, checks the qdiscs and measures the
+// throughput. A rate of 0 sets no limits.
+func (b *benchmarkCNI) runBandwidth(plugins []string, rates []int, write func(*record), w io.Writer) error {
+	b.doLog = debug
+
+	sort.Ints(rates)
+	for _, plugin := range plugins {
+		if !b.chainsBandwidth(plugin) {
+			logrus.WithFields(logrus.Fields{"plugin": plugin}).Info("skipping, the configuration does not chain bandwidth")
+			continue
+		}
+		if err := b.loadCNIConfig(plugin); err != nil {
+			logrus.WithFields(logrus.Fields{"plugin": plugin}).Error(err)
+			continue
+		}
+
+		results := []*bandwidthStats{}
+		for _, mbit := range rates {
+			logrus.WithFields(logrus.Fields{"plugin": plugin, "rate": mbit}).Info("measuring traffic shaping")
+			s := &bandwidthStats{rate: mbitToBits(mbit), add: newHistogram(), del: newHistogram()}
+			for i := 0; i < iterations; i++ {
+				r := b.bandwidthCycle(plugin, mbit)
+				r.Iteration = i
+				if r.Error != "" {
+					s.failures++
+					logrus.WithFields(logrus.Fields{"plugin": plugin, "rate": mbit}).Error(r.Error)
+				} else {
+					s.add.Record(r.Timings.SetupNetNS)
+					s.del.Record(r.Timings.Remove)
+					s.ingress = append(s.ingress, r.Bandwidth.Ingress)
+					s.egress = append(s.egress, r.Bandwidth.Egress)
+				}
+				write(r)
+			}
+			results = append(results, s)
+		}
+
+		if err := printBandwidth(w, plugin, results); err != nil {
+			return fmt.Errorf("printing bandwidth results failed: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// bandwidthCycle creates a pod, attaches the network limited to mbit Mbit/s,
+// checks the shaping and tears it all down.
+func (b *benchmarkCNI) bandwidthCycle(plugin string, mbit int) *record {
+	r := &record{Plugin: plugin, Rate: mbit}
+	rate := mbitToBits(mbit)
+
+	var p *pod
+	if err := timed(&r.Timings.CreateNetNS, func() (err error) {
+		p, err = b.createPod(plugin)
+		return err
+	}); err != nil {
+		r.fail(err)
+		return r
+	}
+	defer p.Close()
+
+	opts := []cni.NamespaceOpts{}
+	if rate > 0 {
+		opts = append(opts, cni.WithCapability("bandwidth", newBandwidthLimits(rate)))
+	}
+	var result *cni.CNIResult
+	if err := timed(&r.Timings.SetupNetNS, func() (err error) {
+		result, err = b.setupNetNS(p, opts...)
+		return err
+	}); err != nil {
+		r.fail(err)
+		// Try to clean up whatever got created, the ifb device and its
+		// qdisc included.
+		b.removeNetNS(p, opts...)
+		return r
+	}
+	r.Result = newCNIResult(result)
+
+	var err error
+	r.Bandwidth, err = b.checkBandwidth(p, result, rate)
+	r.fail(err)
+
+	r.fail(timed(&r.Timings.Remove, func() error {
+		return b.removeNetNS(p, opts...)
+	}))
+	r.fail(timed(&r.Timings.DestroyNetNS, p.Close))
+
+	return r
+}
+
+// checkBandwidth looks for the tbf qdiscs on the host veth and the ifb
+// device the egress traffic is redirected to, then measures the throughput
+// in both directions.
+func (b *benchmarkCNI) checkBandwidth(p *pod, result *cni.CNIResult, rate uint64) (*bandwidthResult, error) {
+	ipConfig, err := primaryIPConfig(result)
+	if err != nil {
+		return nil, err
+	}
+	if ipConfig.Gateway == nil {
+		return nil, fmt.Errorf("result has no gateway for the default interface")
+	}
+	podIP, hostIP := ipConfig.IP, ipConfig.Gateway
+
+	bw := &bandwidthResult{}
+	veth, err := hostVeth(result)
+	if err != nil {
+		return nil, err
+	}
+	bw.HostVeth = veth.Attrs().Name
+
+	if rate > 0 {
+		if err := bw.findQdiscs(veth); err != nil {
+			return bw, err
+		}
+	}
+
+	pod, host := endpoint{pod: p, ip: podIP}, endpoint{ip: hostIP}
+	// Host to pod, shaped by the tbf on the host veth.
+	bw.Ingress, err = b.tcpThroughput(host, pod, shapeDuration)
+	if err != nil {
+		return bw, fmt.Errorf("measuring ingress throughput failed: %v", err)
+	}
+	// Pod to host, shaped by the tbf on the ifb.
+	bw.Egress, err = b.tcpThroughput(pod, host, shapeDuration)
+	if err != nil {
+		return bw, fmt.Errorf("measuring egress throughput failed: %v", err)
+	}
+
+	return bw, nil
+}
+
+// hostVeth returns the host side of the pod veth pair from the result.
+func hostVeth(result *cni.CNIResult) (netlink.Link, error) {
+	for name, iface := range result.Interfaces {
+		if iface.Sandbox != "" {
+			continue
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			continue
+		}
+		if link.Type() == "veth" {
+			return link, nil
+		}
+	}
+	return nil, fmt.Errorf("result has no host veth")
+}
+
+// findQdiscs records the rates of the tbf qdisc on the host veth and of the
+// one on the ifb device the ingress filter of the host veth redirects to.
+func (bw *bandwidthResult) findQdiscs(veth netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(veth)
+	if err != nil {
+		return fmt.Errorf("listing qdiscs of %s failed: %v", bw.HostVeth, err)
+	}
+	for _, q := range qdiscs {
+		if tbf, ok := q.(*netlink.Tbf); ok {
+			// The kernel has bytes per second.
+			bw.IngressQdisc = tbf.Rate * 8
+		}
+	}
+	if bw.IngressQdisc == 0 {
+		// Plugins older than the bandwidth capability ignore runtimeConfig.
+		return fmt.Errorf("no tbf qdisc on host veth %s, the bandwidth plugin may not support the bandwidth capability", bw.HostVeth)
+	}
+
+	filters, err := netlink.FilterList(veth, netlink.HANDLE_INGRESS)
+	if err != nil {
+		return fmt.Errorf("listing ingress filters of %s failed: %v", bw.HostVeth, err)
+	}
+	for _, f := range filters {
+		u32, ok := f.(*netlink.U32)
+		if !ok || u32.RedirIndex == 0 {
+			continue
+		}
+		ifb, err := netlink.LinkByIndex(u32.RedirIndex)
+		if err != nil || ifb.Type() != "ifb" {
+			continue
+		}
+		bw.IFB = ifb.Attrs().Name
+
+		qdiscs, err := netlink.QdiscList(ifb)
+		if err != nil {
+			return fmt.Errorf("listing qdiscs of %s failed: %v", bw.IFB, err)
+		}
+		for _, q := range qdiscs {
+			if tbf, ok := q.(*netlink.Tbf); ok {
+				bw.EgressQdisc = tbf.Rate * 8
+			}
+		}
+	}
+	if bw.IFB == "" {
+		return fmt.Errorf("no filter on host veth %s redirecting to an ifb device", bw.HostVeth)
+	}
+	if bw.EgressQdisc == 0 {
+		return fmt.Errorf("no tbf qdisc on ifb device %s", bw.IFB)
+	}
+	return nil
+}
+
+// printBandwidth writes a table of the ADD and DEL latency and the achieved
+// throughput by rate limit. The cost is relative to the smallest rate, pass
+// 0 to compare with no shaping at all.
+func printBandwidth(w io.Writer, plugin string, results []*bandwidthStats) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 10, 1, 3, ' ', 0)
+	fmt.Fprintln(tw, "PLUGIN\tRATE\tN\tFAILED\tINGRESS\tEGRESS\tADD MEAN\tADD COST\tDEL MEAN\tDEL COST")
+	base := results[0]
+	for _, s := range results {
+		limit := "none"
+		if s.rate > 0 {
+			limit = formatRate(float64(s.rate))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			plugin, limit, s.add.Count(), s.failures,
+			formatThroughput(mean(s.ingress), s.rate), formatThroughput(mean(s.egress), s.rate),
+			round(s.add.Mean()), cost(s.add.Mean()-base.add.Mean()),
+			round(s.del.Mean()), cost(s.del.Mean()-base.del.Mean()))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// formatThroughput returns the throughput and how much of the rate limit it
+// is.
+func formatThroughput(bps float64, rate uint64) string {
+	if rate == 0 {
+		return formatRate(bps)
+	}
+	return fmt.Sprintf("%s (%.0f%%)", formatRate(bps), bps/float64(rate)*100)
+}
+
+// formatRate returns bits per second in Mbit/s or Gbit/s.
+func formatRate(bps float64) string {
+	if bps >= 1e9 {
+		return fmt.Sprintf("%.2fGbit/s", bps/1e9)
+	}
+	return fmt.Sprintf("%.1fMbit/s", bps/1e6)
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestNewBandwidthLimits(t *testing.T) {
+	for _, tc := range []struct {
+		mbit  int
+		burst uint64
+	}{
+		// 20ms of 10Mbit/s is less than the minimum burst.
+		{10, minBurst},
+		{1000, 20 * 1000 * 1000},
+	} {
+		l := newBandwidthLimits(mbitToBits(tc.mbit))
+		if l.IngressRate != mbitToBits(tc.mbit) || l.EgressRate != mbitToBits(tc.mbit) {
+			t.Errorf("%dMbit/s: expected rates of %d, got %d and %d", tc.mbit, mbitToBits(tc.mbit), l.IngressRate, l.EgressRate)
+		}
+		if l.IngressBurst != tc.burst || l.EgressBurst != tc.burst {
+			t.Errorf("%dMbit/s: expected bursts of %d, got %d and %d", tc.mbit, tc.burst, l.IngressBurst, l.EgressBurst)
+		}
+	}
+}
+
+func TestFormatThroughput(t *testing.T) {
+	for _, tc := range []struct {
+		bps      float64
+		rate     uint64
+		expected string
+	}{
+		{2.5e9, 0, "2.50Gbit/s"},
+		{9.5e6, mbitToBits(10), "9.5Mbit/s (95%)"},
+	} {
+		if got := formatThroughput(tc.bps, tc.rate); got != tc.expected {
+			t.Errorf("formatThroughput(%v, %d): expected %q, got %q", tc.bps, tc.rate, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// kneeGain is the minimum throughput gain from adding workers we still count
+// as scaling. Past that point the plugin is saturated.
+const kneeGain = 1.1
+
+// churnResult is the outcome of running the churn benchmark for a plugin
+// with a number of concurrent workers.
+type churnResult struct {
+	plugin      string
+	concurrency int
+	elapsed     time.Duration
+	cycles      int
+	add         *histogram
+	del         *histogram
+	// errors counts the failed cycles by their likely cause.
+	errors map[string]int
+}
+
+// throughput returns the number of successful ADD/DEL cycles per second.
+func (c *churnResult) throughput() float64 {
+	if c.elapsed == 0 {
+		return 0
+	}
+	return float64(c.cycles) / c.elapsed.Seconds()
+}
+
+// runChurn runs the churn benchmark for every plugin at every concurrency in
+// the sweep. Each worker runs -iterations ADD/DEL cycles.
+func (b *benchmarkCNI) runChurn(plugins []string, sweep []int, write func(*record), w io.Writer) error {
+	// Logging every cycle from every worker is just noise.
+	b.doLog = debug
+
+	for _, plugin := range plugins {
+		if err := b.loadCNIConfig(plugin); err != nil {
+			logrus.WithFields(logrus.Fields{"plugin": plugin}).Error(err)
+			continue
+		}
+
+		// Warm up with a single worker, the results are thrown away.
+		if warmup > 0 {
+			b.churn(plugin, 1, warmup, nil)
+		}
+
+		results := []*churnResult{}
+		for _, n := range sweep {
+			if n < 1 {
+				continue
+			}
+			logrus.WithFields(logrus.Fields{"plugin": plugin, "concurrency": n}).Info("running pod churn")
+			results = append(results, b.churn(plugin, n, iterations, write))
+		}
+		if err := printChurn(w, results); err != nil {
+			return fmt.Errorf("printing churn results failed: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// churn starts n workers that each create a pod, ADD and DEL the network
+// and destroy the pod perWorker times, all against the same plugin. The
+// plugin configuration must already be loaded. Every cycle is passed to
+// write, which is never called concurrently.
+func (b *benchmarkCNI) churn(plugin string, n, perWorker int, write func(*record)) *churnResult {
+	c := &churnResult{
+		plugin:      plugin,
+		concurrency: n,
+		add:         newHistogram(),
+		del:         newHistogram(),
+		errors:      map[string]int{},
+	}
+
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		ready sync.WaitGroup
+		start = make(chan struct{})
+	)
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		ready.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			// Every worker gets its own OS thread so namespace handles
+			// and setns calls never leak between workers.
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+
+			ready.Done()
+			<-start
+
+			for i := 0; i < perWorker; i++ {
+				r := b.churnCycle(plugin)
+				r.Iteration = w*perWorker + i
+				r.Concurrency = n
+
+				mu.Lock()
+				if r.Error != "" {
+					c.errors[contentionReason(r.Error)]++
+					logrus.WithFields(logrus.Fields{"plugin": plugin, "concurrency": n, "worker": w}).Debug(r.Error)
+				} else {
+					c.cycles++
+					c.add.Record(r.Timings.SetupNetNS)
+					c.del.Record(r.Timings.Remove)
+				}
+				if write != nil {
+					write(r)
+				}
+				mu.Unlock()
+			}
+		}(w)
+	}
+
+	// Start all the workers at the same time.
+	ready.Wait()
+	begin := time.Now()
+	close(start)
+	wg.Wait()
+	c.elapsed = time.Since(begin)
+
+	return c
+}
+
+// churnCycle creates a pod, attaches and detaches the network and destroys
+// the pod again.
+func (b *benchmarkCNI) churnCycle(plugin string) *record {
+	r := &record{Plugin: plugin}
+
+	var p *pod
+	if err := timed(&r.Timings.CreateNetNS, func() (err error) {
+		p, err = b.createPod(plugin)
+		return err
+	}); err != nil {
+		r.fail(err)
+		return r
+	}
+	defer p.Close()
+
+	if err := timed(&r.Timings.SetupNetNS, func() (err error) {
+		_, err = b.setupNetNS(p)
+		return err
+	}); err != nil {
+		r.fail(err)
+		// Try to clean up whatever got created.
+		b.removeNetNS(p)
+		return r
+	}
+
+	r.fail(timed(&r.Timings.Remove, func() error {
+		return b.removeNetNS(p)
+	}))
+
+	r.fail(timed(&r.Timings.DestroyNetNS, p.Close))
+
+	return r
+}
+
+// contentionReason groups errors by the kind of contention they most likely
+// come from, like the host-local IPAM file lock or two ADDs racing to create
+// the same bridge.
+func contentionReason(err string) string {
+	e := strings.ToLower(err)
+	switch {
+	case strings.Contains(e, "lock"):
+		return "lock"
+	case strings.Contains(e, "exists"):
+		return "already exists"
+	case strings.Contains(e, "busy"), strings.Contains(e, "temporarily unavailable"):
+		return "busy"
+	case strings.Contains(e, "no ip addresses available"), strings.Contains(e, "no available"):
+		return "ipam exhausted"
+	case strings.Contains(e, "timeout"), strings.Contains(e, "timed out"):
+		return "timeout"
+	}
+	return "other"
+}
+
+// throughputKnee returns the concurrency after which adding workers stops
+// increasing throughput by at least kneeGain.
+func throughputKnee(results []*churnResult) int {
+	if len(results) == 0 {
+		return 0
+	}
+	for i := 0; i < len(results)-1; i++ {
+		if results[i+1].throughput() < results[i].throughput()*kneeGain {
+			return results[i].concurrency
+		}
+	}
+	return results[len(results)-1].concurrency
+}
+
+// printChurn writes a table with the throughput and latencies of each
+// concurrency level for a plugin. The slowdown column is the mean ADD
+// latency relative to the lowest concurrency, a rough measure of how much
+// time is spent waiting on locks.
+func printChurn(w io.Writer, results []*churnResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 10, 1, 3, ' ', 0)
+	fmt.Fprintln(tw, "PLUGIN\tN\tCYCLES/S\tADD P50\tADD P99\tDEL P50\tDEL P99\tSLOWDOWN\tERRORS")
+	base := results[0].add.Mean()
+	for _, c := range results {
+		slowdown := "-"
+		if base > 0 && c.add.Count() > 0 {
+			slowdown = fmt.Sprintf("%.2fx", float64(c.add.Mean())/float64(base))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%.2f\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			c.plugin, c.concurrency, c.throughput(),
+			round(c.add.Percentile(50)), round(c.add.Percentile(99)),
+			round(c.del.Percentile(50)), round(c.del.Percentile(99)),
+			slowdown, formatErrors(c.errors))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "%s: throughput knee at concurrency %d\n\n", results[0].plugin, throughputKnee(results))
+	return err
+}
+
+// formatErrors returns the error counts as reason=count, sorted by reason.
+func formatErrors(errors map[string]int) string {
+	if len(errors) == 0 {
+		return "0"
+	}
+	reasons := []string{}
+	for reason, count := range errors {
+		reasons = append(reasons, fmt.Sprintf("%s=%d", reason, count))
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, ",")
+}
+
+// parseIntList parses a comma separated list of non-negative integers.
+func parseIntList(s string) ([]int, error) {
+	ints := []int{}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		i, err := strconv.Atoi(f)
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("%q is not a valid non-negative integer", f)
+		}
+		ints = append(ints, i)
+	}
+	return ints, nil
+}
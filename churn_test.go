@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestThroughputKnee(t *testing.T) {
+	results := []*churnResult{}
+	for _, c := range []struct{ n, cycles int }{{1, 10}, {2, 20}, {4, 36}, {8, 38}, {16, 30}} {
+		results = append(results, &churnResult{concurrency: c.n, cycles: c.cycles, elapsed: time.Second})
+	}
+
+	if knee := throughputKnee(results); knee != 4 {
+		t.Fatalf("expected the knee at 4, got %d", knee)
+	}
+	if knee := throughputKnee(results[:3]); knee != 4 {
+		t.Fatalf("expected the knee at the last concurrency when still scaling, got %d", knee)
+	}
+}
+
+func TestContentionReason(t *testing.T) {
+	for err, expected := range map[string]string{
+		"failed to lock /var/lib/cni/networks/bridge/lock": "lock",
+		`failed to create bridge "cni0": file exists`:      "already exists",
+		"device or resource busy":                          "busy",
+		"no IP addresses available in range set":           "ipam exhausted",
+		"something else":                                   "other",
+	} {
+		if got := contentionReason(err); got != expected {
+			t.Fatalf("expected %q for %q, got %q", expected, err, got)
+		}
+	}
+}
+
+func TestParseIntList(t *testing.T) {
+	got, err := parseIntList("1, 2,4,,8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{1, 2, 4, 8}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	if _, err := parseIntList("1,-2"); err == nil {
+		t.Fatal("expected an error for a negative number")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+// addresses returns the gateway, the first address of the subnet, and
+// reserves an address for the attachment. The search starts at an address
+// derived from the key and probes the next ones, every reservation is a file
+// named after the address in dir with the key in it, like host-local keeps
+// them. An attachment that already has an address gets it again. The boolean
+// reports whether the reservation is new, only then is it the caller's to
+// release when the ADD fails.
+func addresses(subnet *net.IPNet, dir, key string) (net.IP, *net.IPNet, bool, error) {
+	ones, bits := subnet.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	if size < 4 {
+		return nil, nil, false, &types.Error{Code: errInvalidNetworkConfig, Msg: fmt.Sprintf("subnet %s is too small", subnet)}
+	}
+	base := binary.BigEndian.Uint32(subnet.IP.To4())
+	gateway := make(net.IP, 4)
+	binary.BigEndian.PutUint32(gateway, base+1)
+
+	unlock, err := lockDir(dir)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	defer unlock()
+
+	// Skip the network, the gateway and the broadcast address.
+	sum := sha1.Sum([]byte(key))
+	start := binary.BigEndian.Uint32(sum[:4]) % (size - 3)
+	for i := uint32(0); i < size-3; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+(start+i)%(size-3)+2)
+		file := filepath.Join(dir, ip.String())
+
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			if owner, err := ioutil.ReadFile(file); err == nil && string(owner) == key {
+				return gateway, &net.IPNet{IP: ip, Mask: subnet.Mask}, false, nil
+			}
+			continue
+		}
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("reserving %s failed: %v", ip, err)
+		}
+		_, err = f.WriteString(key)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(file)
+			return nil, nil, false, fmt.Errorf("reserving %s failed: %v", ip, err)
+		}
+		return gateway, &net.IPNet{IP: ip, Mask: subnet.Mask}, true, nil
+	}
+	return nil, nil, false, fmt.Errorf("no free address left in %s", subnet)
+}
+
+// release removes the reservations of the attachment. It is fine if there
+// are none.
+func release(dir, key string) error {
+	unlock, err := lockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("reading %s failed: %v", dir, err)
+	}
+	for _, f := range files {
+		if f.IsDir() || f.Name() == "lock" {
+			continue
+		}
+		file := filepath.Join(dir, f.Name())
+		if owner, err := ioutil.ReadFile(file); err != nil || string(owner) != key {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			return fmt.Errorf("releasing %s failed: %v", f.Name(), err)
+		}
+	}
+	return nil
+}
+
+// lockDir creates dir and takes the lock of the plugins sharing it. The
+// returned function releases it.
+func lockDir(dir string) (func(), error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating data directory %s failed: %v", dir, err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening lock of %s failed: %v", dir, err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking %s failed: %v", dir, err)
+	}
+	// Closing the file releases the lock.
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,401 @@
+// Command fake-cni is a CNI plugin for testing the benchmark harness without
+// real plugins or daemons. It can set up a veth pair with an address in the
+// network namespace, or do nothing at all, and every command can be made to
+// take longer, fail or hang.
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	modeVeth = "veth"
+	modeNone = "none"
+
+	defaultSubnet  = "10.99.0.0/16"
+	defaultDataDir = "/run/cni/fake-cni"
+)
+
+// Error codes from the CNI spec, the vendored types package predates them.
+const (
+	errIncompatibleCNIVersion      = 1
+	errInvalidEnvironmentVariables = 4
+	errDecodingFailure             = 6
+	errInvalidNetworkConfig        = 7
+	errInternal                    = 999
+)
+
+// supportedVersions are the CNI spec versions the plugin can return results
+// for.
+var supportedVersions = []string{"0.1.0", "0.2.0", "0.3.0", "0.3.1"}
+
+// netConf is the network configuration passed on stdin.
+type netConf struct {
+	types.NetConf
+
+	// Mode is either veth, to create a veth pair with an address in the
+	// network namespace, or none, to only return a result.
+	Mode string `json:"mode"`
+	// Subnet the addresses are picked from, the first address is the
+	// gateway on the host side.
+	Subnet string `json:"subnet"`
+	MTU    int    `json:"mtu"`
+	// DataDir keeps a file per address in use, like host-local, in a
+	// directory named after the network.
+	DataDir string `json:"dataDir"`
+
+	Add behavior `json:"add"`
+	Del behavior `json:"del"`
+}
+
+// behavior controls how long a command takes and whether it fails.
+type behavior struct {
+	// Latency is added to every execution of the command, plus a random
+	// amount of up to Jitter.
+	Latency duration `json:"latency"`
+	Jitter  duration `json:"jitter"`
+	// FailureRate is the fraction of executions, between 0 and 1, that
+	// return ErrorCode and ErrorMsg.
+	FailureRate float64 `json:"failureRate"`
+	ErrorCode   uint    `json:"errorCode"`
+	ErrorMsg    string  `json:"errorMsg"`
+	// HangRate is the fraction of executions that hang for HangFor, or
+	// until killed if HangFor is not set.
+	HangRate float64  `json:"hangRate"`
+	HangFor  duration `json:"hangFor"`
+}
+
+// duration is a time.Duration that is a string like "20ms" in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func main() {
+	// All the namespace switching has to happen on the same thread.
+	runtime.LockOSThread()
+	rand.Seed(time.Now().UnixNano() ^ int64(os.Getpid()))
+
+	if err := run(); err != nil {
+		e, ok := err.(*types.Error)
+		if !ok {
+			e = &types.Error{Code: errInternal, Msg: err.Error()}
+		}
+		e.Print()
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	command := os.Getenv("CNI_COMMAND")
+	if command == "VERSION" {
+		return json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"cniVersion":        current.ImplementedSpecVersion,
+			"supportedVersions": supportedVersions,
+		})
+	}
+
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("reading stdin failed: %v", err)
+	}
+	conf := &netConf{Mode: modeVeth, Subnet: defaultSubnet, DataDir: defaultDataDir}
+	if err := json.Unmarshal(stdin, conf); err != nil {
+		return &types.Error{Code: errDecodingFailure, Msg: fmt.Sprintf("decoding config failed: %v", err)}
+	}
+	if conf.CNIVersion == "" {
+		conf.CNIVersion = "0.1.0"
+	}
+	if !supported(conf.CNIVersion) {
+		return &types.Error{Code: errIncompatibleCNIVersion, Msg: fmt.Sprintf("incompatible CNI version %q", conf.CNIVersion)}
+	}
+	if conf.Mode != modeVeth && conf.Mode != modeNone {
+		return &types.Error{Code: errInvalidNetworkConfig, Msg: fmt.Sprintf("unknown mode %q, must be %s or %s", conf.Mode, modeVeth, modeNone)}
+	}
+
+	args := &cmdArgs{
+		containerID: os.Getenv("CNI_CONTAINERID"),
+		netns:       os.Getenv("CNI_NETNS"),
+		ifName:      os.Getenv("CNI_IFNAME"),
+	}
+	if args.containerID == "" || args.ifName == "" {
+		return &types.Error{Code: errInvalidEnvironmentVariables, Msg: "CNI_CONTAINERID and CNI_IFNAME are required"}
+	}
+
+	switch command {
+	case "ADD":
+		if err := conf.Add.apply(); err != nil {
+			return err
+		}
+		return add(conf, args)
+	case "DEL":
+		if err := conf.Del.apply(); err != nil {
+			return err
+		}
+		return del(conf, args)
+	}
+	return &types.Error{Code: errInvalidEnvironmentVariables, Msg: fmt.Sprintf("unknown CNI_COMMAND %q", command)}
+}
+
+type cmdArgs struct {
+	containerID string
+	netns       string
+	ifName      string
+}
+
+// key identifies the attachment in the data directory.
+func (a *cmdArgs) key() string {
+	return a.containerID + "\n" + a.ifName
+}
+
+// dataDir returns the directory of the network in DataDir.
+func (c *netConf) dataDir() string {
+	return filepath.Join(c.DataDir, c.Name)
+}
+
+// apply sleeps, hangs or fails according to the behavior.
+func (b behavior) apply() error {
+	sleep := time.Duration(b.Latency)
+	if b.Jitter > 0 {
+		sleep += time.Duration(rand.Int63n(int64(b.Jitter)))
+	}
+	time.Sleep(sleep)
+
+	if b.HangRate > 0 && rand.Float64() < b.HangRate {
+		if b.HangFor <= 0 {
+			select {}
+		}
+		time.Sleep(time.Duration(b.HangFor))
+	}
+
+	if b.FailureRate > 0 && rand.Float64() < b.FailureRate {
+		code, msg := b.ErrorCode, b.ErrorMsg
+		if code == 0 {
+			code = errInternal
+		}
+		if msg == "" {
+			msg = "injected failure"
+		}
+		return &types.Error{Code: code, Msg: msg}
+	}
+	return nil
+}
+
+func add(conf *netConf, args *cmdArgs) error {
+	_, subnet, err := net.ParseCIDR(conf.Subnet)
+	if err != nil || subnet.IP.To4() == nil {
+		return &types.Error{Code: errInvalidNetworkConfig, Msg: fmt.Sprintf("subnet %q must be an IPv4 CIDR", conf.Subnet)}
+	}
+	gateway, address, reserved, err := addresses(subnet, conf.dataDir(), args.key())
+	if err != nil {
+		return err
+	}
+
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		IPs: []*current.IPConfig{{
+			Version: "4",
+			Address: *address,
+			Gateway: gateway,
+		}},
+		Routes: []*types.Route{{
+			Dst: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			GW:  gateway,
+		}},
+	}
+
+	if conf.Mode == modeVeth {
+		host, pod, err := setupVeth(conf, args, gateway, address)
+		if err != nil {
+			// A repeated ADD fails on the existing veth, the address is
+			// still the one of the attachment that has it.
+			if reserved {
+				release(conf.dataDir(), args.key())
+			}
+			return err
+		}
+		result.Interfaces = []*current.Interface{host, pod}
+		result.IPs[0].Interface = current.Int(1)
+	}
+
+	r, err := result.GetAsVersion(conf.CNIVersion)
+	if err != nil {
+		return err
+	}
+	return r.Print()
+}
+
+func del(conf *netConf, args *cmdArgs) error {
+	if err := release(conf.dataDir(), args.key()); err != nil {
+		return err
+	}
+	if conf.Mode != modeVeth {
+		return nil
+	}
+
+	// Deleting the host side deletes the peer in the namespace as well. It
+	// is fine if it is already gone.
+	link, err := netlink.LinkByName(vethName(args))
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("looking up host veth failed: %v", err)
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("deleting host veth failed: %v", err)
+	}
+	return nil
+}
+
+// vethName returns the name of the host side of the veth pair.
+func vethName(args *cmdArgs) string {
+	sum := sha1.Sum([]byte(args.containerID + args.ifName))
+	return "fake" + hex.EncodeToString(sum[:])[:8]
+}
+
+// setupVeth creates a veth pair, moves one end into the namespace and
+// configures it like the ptp plugin: the host side gets the gateway address
+// and a route to the container.
+func setupVeth(conf *netConf, args *cmdArgs, gateway net.IP, address *net.IPNet) (*current.Interface, *current.Interface, error) {
+	if args.netns == "" {
+		return nil, nil, &types.Error{Code: errInvalidEnvironmentVariables, Msg: "CNI_NETNS is required"}
+	}
+	hostNS, err := netns.Get()
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting current netns failed: %v", err)
+	}
+	defer hostNS.Close()
+	podNS, err := netns.GetFromPath(args.netns)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening netns %s failed: %v", args.netns, err)
+	}
+	defer podNS.Close()
+
+	hostName := vethName(args)
+	peerName := "p" + hostName
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: hostName, MTU: conf.MTU},
+		PeerName:  peerName,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return nil, nil, fmt.Errorf("creating veth pair failed: %v", err)
+	}
+	host, err := netlink.LinkByName(hostName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("looking up host veth failed: %v", err)
+	}
+	peer, err := netlink.LinkByName(peerName)
+	if err != nil {
+		netlink.LinkDel(host)
+		return nil, nil, fmt.Errorf("looking up peer veth failed: %v", err)
+	}
+	if err := netlink.LinkSetNsFd(peer, int(podNS)); err != nil {
+		netlink.LinkDel(host)
+		return nil, nil, fmt.Errorf("moving veth into netns failed: %v", err)
+	}
+
+	// Configure the host side.
+	if err := netlink.AddrAdd(host, &netlink.Addr{IPNet: &net.IPNet{IP: gateway, Mask: net.CIDRMask(32, 32)}}); err != nil {
+		netlink.LinkDel(host)
+		return nil, nil, fmt.Errorf("adding gateway address to host veth failed: %v", err)
+	}
+	if err := netlink.LinkSetUp(host); err != nil {
+		netlink.LinkDel(host)
+		return nil, nil, fmt.Errorf("setting host veth up failed: %v", err)
+	}
+	if err := netlink.RouteAdd(&netlink.Route{
+		LinkIndex: host.Attrs().Index,
+		Dst:       &net.IPNet{IP: address.IP, Mask: net.CIDRMask(32, 32)},
+		Scope:     netlink.SCOPE_LINK,
+		Src:       gateway,
+	}); err != nil {
+		netlink.LinkDel(host)
+		return nil, nil, fmt.Errorf("adding route to container failed: %v", err)
+	}
+
+	// Configure the namespace side.
+	if err := netns.Set(podNS); err != nil {
+		netlink.LinkDel(host)
+		return nil, nil, fmt.Errorf("switching to netns failed: %v", err)
+	}
+	mac, err := configurePeer(peerName, args.ifName, gateway, address)
+	if err := netns.Set(hostNS); err != nil {
+		return nil, nil, fmt.Errorf("returning to host netns failed: %v", err)
+	}
+	if err != nil {
+		netlink.LinkDel(host)
+		return nil, nil, err
+	}
+
+	return &current.Interface{
+		Name: hostName,
+		Mac:  host.Attrs().HardwareAddr.String(),
+	}, &current.Interface{
+		Name:    args.ifName,
+		Mac:     mac,
+		Sandbox: args.netns,
+	}, nil
+}
+
+// configurePeer renames the peer and adds the address and routes. It must
+// run in the container network namespace.
+func configurePeer(peerName, ifName string, gateway net.IP, address *net.IPNet) (string, error) {
+	link, err := netlink.LinkByName(peerName)
+	if err != nil {
+		return "", fmt.Errorf("looking up veth in netns failed: %v", err)
+	}
+	if err := netlink.LinkSetName(link, ifName); err != nil {
+		return "", fmt.Errorf("renaming veth to %s failed: %v", ifName, err)
+	}
+	if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: address}); err != nil {
+		return "", fmt.Errorf("adding address to %s failed: %v", ifName, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return "", fmt.Errorf("setting %s up failed: %v", ifName, err)
+	}
+	if err := netlink.RouteAdd(&netlink.Route{Gw: gateway}); err != nil {
+		return "", fmt.Errorf("adding default route failed: %v", err)
+	}
+
+	// Get the link again for the MAC after the rename.
+	link, err = netlink.LinkByName(ifName)
+	if err != nil {
+		return "", fmt.Errorf("looking up %s failed: %v", ifName, err)
+	}
+	return link.Attrs().HardwareAddr.String(), nil
+}
+
+func supported(version string) bool {
+	for _, v := range supportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
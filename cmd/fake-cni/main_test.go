@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestAddresses(t *testing.T) {
+	testCases := []struct {
+		name     string
+		subnet   string
+		keys     int
+		expected string
+	}{
+		// 250 pods in a /16 collided a third of the time when the address
+		// was only a hash of the container ID.
+		{name: "no collisions", subnet: "10.99.0.0/16", keys: 250},
+		// A /29 has 5 addresses after the network, the gateway and the
+		// broadcast address.
+		{name: "full subnet", subnet: "10.99.0.0/29", keys: 5},
+		{name: "exhausted subnet", subnet: "10.99.0.0/29", keys: 6, expected: "no free address left in 10.99.0.0/29"},
+		{name: "too small", subnet: "10.99.0.0/31", keys: 1, expected: "subnet 10.99.0.0/31 is too small"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "fake-cni")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			_, subnet, _ := net.ParseCIDR(tc.subnet)
+
+			seen := map[string]bool{}
+			for i := 0; i < tc.keys; i++ {
+				gateway, address, reserved, err := addresses(subnet, dir, fmt.Sprintf("%d\neth0", i))
+				if err != nil {
+					if tc.expected == "" || !strings.Contains(err.Error(), tc.expected) {
+						t.Fatalf("expected %q, got %v", tc.expected, err)
+					}
+					return
+				}
+				if !reserved {
+					t.Fatalf("expected address %d to be a new reservation", i)
+				}
+				if gateway.String() != "10.99.0.1" {
+					t.Fatalf("expected gateway 10.99.0.1, got %s", gateway)
+				}
+				ip := address.IP.String()
+				if seen[ip] || ip == "10.99.0.0" || ip == "10.99.0.1" || !subnet.Contains(address.IP) {
+					t.Fatalf("address %d is %s, taken or not for a pod", i, ip)
+				}
+				seen[ip] = true
+			}
+			if tc.expected != "" {
+				t.Fatalf("expected %q, got %d addresses", tc.expected, len(seen))
+			}
+		})
+	}
+}
+
+func TestAddressesRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fake-cni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, subnet, _ := net.ParseCIDR("10.99.0.0/29")
+
+	_, first, _, err := addresses(subnet, dir, "a\neth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second ADD of the same attachment gets the same address.
+	_, again, reserved, err := addresses(subnet, dir, "a\neth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reserved {
+		t.Fatal("expected the second ADD to reuse the reservation, not to make one")
+	}
+	if !again.IP.Equal(first.IP) {
+		t.Fatalf("expected %s again, got %s", first.IP, again.IP)
+	}
+	_, other, _, err := addresses(subnet, dir, "a\neth1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.IP.Equal(first.IP) {
+		t.Fatalf("expected another interface of the pod to get another address than %s", first.IP)
+	}
+
+	if err := release(dir, "a\neth0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir + "/" + first.IP.String()); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be released, got %v", first.IP, err)
+	}
+	if _, err := os.Stat(dir + "/" + other.IP.String()); err != nil {
+		t.Fatalf("expected %s to be kept: %v", other.IP, err)
+	}
+	// Releasing twice is fine.
+	if err := release(dir, "a\neth0"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVethName(t *testing.T) {
+	testCases := []struct {
+		args cmdArgs
+	}{
+		{args: cmdArgs{containerID: "1234", ifName: "eth0"}},
+		{args: cmdArgs{containerID: "1234", ifName: "eth1"}},
+		{args: cmdArgs{containerID: "5678", ifName: "eth0"}},
+		{args: cmdArgs{containerID: strings.Repeat("f", 64), ifName: "eth0"}},
+	}
+	seen := map[string]bool{}
+	for _, tc := range testCases {
+		name := vethName(&tc.args)
+		// IFNAMSIZ is 16 with the terminating NUL.
+		if !strings.HasPrefix(name, "fake") || len(name) > 15 {
+			t.Errorf("%s %s: %q is not a valid link name", tc.args.containerID, tc.args.ifName, name)
+		}
+		// The peer is named p<name> before it is renamed.
+		if len("p"+name) > 15 {
+			t.Errorf("%s %s: peer name of %q is too long", tc.args.containerID, tc.args.ifName, name)
+		}
+		if seen[name] {
+			t.Errorf("%s %s: %q is not unique", tc.args.containerID, tc.args.ifName, name)
+		}
+		seen[name] = true
+		if again := vethName(&tc.args); again != name {
+			t.Errorf("%s %s: expected %q again, got %q", tc.args.containerID, tc.args.ifName, name, again)
+		}
+	}
+}
+
+func TestBehavior(t *testing.T) {
+	testCases := []struct {
+		name     string
+		behavior behavior
+		// minimum is how long apply takes at least.
+		minimum time.Duration
+		code    uint
+		msg     string
+	}{
+		{name: "nothing"},
+		{name: "latency", behavior: behavior{Latency: duration(20 * time.Millisecond)}, minimum: 20 * time.Millisecond},
+		{name: "jitter", behavior: behavior{Latency: duration(10 * time.Millisecond), Jitter: duration(time.Millisecond)}, minimum: 10 * time.Millisecond},
+		{name: "never fails", behavior: behavior{FailureRate: 0, ErrorCode: 11}},
+		{name: "failure", behavior: behavior{FailureRate: 1}, code: errInternal, msg: "injected failure"},
+		{name: "failure with code", behavior: behavior{FailureRate: 1, ErrorCode: 11, ErrorMsg: "try again"}, code: 11, msg: "try again"},
+		{name: "hang", behavior: behavior{HangRate: 1, HangFor: duration(20 * time.Millisecond)}, minimum: 20 * time.Millisecond},
+		{name: "hang then fail", behavior: behavior{HangRate: 1, HangFor: duration(10 * time.Millisecond), FailureRate: 1}, minimum: 10 * time.Millisecond, code: errInternal, msg: "injected failure"},
+	}
+	for _, tc := range testCases {
+		start := time.Now()
+		err := tc.behavior.apply()
+		if took := time.Since(start); took < tc.minimum {
+			t.Errorf("%s: expected to take at least %s, took %s", tc.name, tc.minimum, took)
+		}
+		if tc.code == 0 {
+			if err != nil {
+				t.Errorf("%s: expected no error, got %v", tc.name, err)
+			}
+			continue
+		}
+		e, ok := err.(*types.Error)
+		if !ok || e.Code != tc.code || e.Msg != tc.msg {
+			t.Errorf("%s: expected error %d %q, got %v", tc.name, tc.code, tc.msg, err)
+		}
+	}
+}
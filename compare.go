@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// errRegression is returned by compare when a regression exceeds the
+// threshold.
+var errRegression = fmt.Errorf("found regressions exceeding the threshold")
+
+// comparison is the result of comparing the samples of one plugin and phase
+// between two runs.
+type comparison struct {
+	name      string
+	old       []float64
+	new       []float64
+	delta     float64
+	p         float64
+	regressed bool
+}
+
+// runCompare implements the compare subcommand.
+func runCompare(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	threshold := fs.Float64("threshold", 5, "percentage a phase has to get slower by to count as a regression")
+	alpha := fs.Float64("alpha", 0.05, "significance level for the Mann-Whitney U test")
+	phases := fs.String("phases", "", "comma separated list of phases to compare (default is all of them)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: cni-benchmarks compare [flags] OLD NEW")
+		fmt.Fprintln(os.Stderr, "\nCompares two result files written with -output json or -output csv.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("compare takes exactly two result files")
+	}
+
+	before, err := loadSamples(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	after, err := loadSamples(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	wanted := map[string]bool{}
+	for _, p := range strings.Split(*phases, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			wanted[p] = true
+		}
+	}
+
+	comparisons := compareSamples(before, after, wanted, *threshold/100, *alpha)
+	if err := printComparisons(w, comparisons, *alpha); err != nil {
+		return err
+	}
+
+	for _, c := range comparisons {
+		if c.regressed {
+			return errRegression
+		}
+	}
+	return nil
+}
+
+// sampleKey identifies the samples of one phase of one plugin in a run.
+type sampleKey struct {
+	name  string
+	phase string
+}
+
+// loadSamples reads a result file written with -output json or -output csv
+// and returns the durations of every phase of every successful run in
+// nanoseconds.
+func loadSamples(path string) (map[sampleKey][]float64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s failed: %v", path, err)
+	}
+
+	var samples map[sampleKey][]float64
+	trimmed := bytes.TrimSpace(b)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		samples, err = jsonSamples(trimmed)
+	} else {
+		samples, err = csvSamples(trimmed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s failed: %v", path, err)
+	}
+	return samples, nil
+}
+
+func jsonSamples(b []byte) (map[sampleKey][]float64, error) {
+	records := []*record{}
+	if b[0] == '[' {
+		if err := json.Unmarshal(b, &records); err != nil {
+			return nil, err
+		}
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		for {
+			r := &record{}
+			if err := dec.Decode(r); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			records = append(records, r)
+		}
+	}
+
+	samples := map[sampleKey][]float64{}
+	for _, r := range records {
+		if r.Error != "" {
+			continue
+		}
+		name := sampleName(r.Plugin, r.Concurrency, r.Attachments, r.Ports, r.Rate, r.CNIVersion)
+		for _, p := range r.Timings.phases() {
+			addSample(samples, sampleKey{name, p.Name}, p.Duration)
+		}
+		if r.Readiness != nil {
+			addSample(samples, sampleKey{name, firstPacketPhase}, r.Readiness.FirstPacket)
+		}
+	}
+	return samples, nil
+}
+
+func csvSamples(b []byte) (map[sampleKey][]float64, error) {
+	rows, err := csv.NewReader(bufio.NewReader(bytes.NewReader(b))).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("no header found")
+	}
+
+	columns := map[string]int{}
+	for i, name := range rows[0] {
+		columns[name] = i
+	}
+	for _, name := range []string{"plugin", "error"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing %s column", name)
+		}
+	}
+	value := func(row []string, name string) string {
+		i, ok := columns[name]
+		if !ok {
+			return ""
+		}
+		return row[i]
+	}
+	atoi := func(row []string, name string) int {
+		v, _ := strconv.Atoi(value(row, name))
+		return v
+	}
+
+	samples := map[sampleKey][]float64{}
+	for _, row := range rows[1:] {
+		if row[columns["error"]] != "" {
+			continue
+		}
+		name := sampleName(row[columns["plugin"]], atoi(row, "concurrency"), atoi(row, "attachments"), atoi(row, "ports"), atoi(row, "rate"), value(row, "cniVersion"))
+		for _, p := range (timings{}).phases() {
+			i, ok := columns[p.Name]
+			if !ok {
+				i, ok = columns[oldPhaseNames[p.Name]]
+			}
+			if !ok {
+				continue
+			}
+			ns, err := strconv.ParseInt(row[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parsing %s %q failed: %v", p.Name, row[i], err)
+			}
+			addSample(samples, sampleKey{name, p.Name}, time.Duration(ns))
+		}
+		// Empty when the plugin was not probed or never became ready.
+		if v := value(row, firstPacketPhase); v != "" {
+			ns, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parsing %s %q failed: %v", firstPacketPhase, v, err)
+			}
+			addSample(samples, sampleKey{name, firstPacketPhase}, time.Duration(ns))
+		}
+	}
+	return samples, nil
+}
+
+// sampleName returns the name of a plugin run, including the benchmark mode
+// it ran in.
+func sampleName(plugin string, concurrency, attachments, ports, rate int, cniVersion string) string {
+	if concurrency > 0 {
+		plugin += fmt.Sprintf("/concurrency=%d", concurrency)
+	}
+	if attachments > 0 {
+		plugin += fmt.Sprintf("/attached=%d", attachments)
+	}
+	if ports > 0 {
+		plugin += fmt.Sprintf("/ports=%d", ports)
+	}
+	if rate > 0 {
+		plugin += fmt.Sprintf("/rate=%dMbit", rate)
+	}
+	if cniVersion != "" {
+		plugin += "/cniVersion=" + cniVersion
+	}
+	return plugin
+}
+
+func addSample(samples map[sampleKey][]float64, key sampleKey, d time.Duration) {
+	// Phases that did not run are zero.
+	if d <= 0 {
+		return
+	}
+	samples[key] = append(samples[key], float64(d))
+}
+
+// compareSamples compares every phase present in both runs. A phase
+// regressed when it got slower by more than threshold and the difference is
+// significant at alpha.
+func compareSamples(before, after map[sampleKey][]float64, phases map[string]bool, threshold, alpha float64) []*comparison {
+	keys := []sampleKey{}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			continue
+		}
+		if len(phases) > 0 && !phases[k.phase] {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	// Sort by name, then by the order the phases run in, with the first
+	// packet right after the readiness wait it ends.
+	order := map[string]int{}
+	for _, p := range (timings{}).phases() {
+		order[p.Name] = len(order)
+		if p.Name == "ready" {
+			order[firstPacketPhase] = len(order)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return order[keys[i].phase] < order[keys[j].phase]
+	})
+
+	comparisons := []*comparison{}
+	for _, k := range keys {
+		c := &comparison{
+			name: k.name + " " + k.phase,
+			old:  before[k],
+			new:  after[k],
+			p:    mannWhitneyU(before[k], after[k]),
+		}
+		oldMean, newMean := mean(c.old), mean(c.new)
+		if oldMean > 0 {
+			c.delta = (newMean - oldMean) / oldMean
+		}
+		c.regressed = c.p < alpha && c.delta > threshold
+		comparisons = append(comparisons, c)
+	}
+	return comparisons
+}
+
+// printComparisons writes a benchstat style table of the comparisons.
+func printComparisons(w io.Writer, comparisons []*comparison, alpha float64) error {
+	tw := tabwriter.NewWriter(w, 10, 1, 3, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tOLD\tNEW\tDELTA\t")
+	for _, c := range comparisons {
+		delta := "~"
+		if c.p < alpha {
+			delta = fmt.Sprintf("%+.2f%%", c.delta*100)
+		}
+		note := fmt.Sprintf("(p=%.3f n=%d+%d)", c.p, len(c.old), len(c.new))
+		if c.regressed {
+			note += " REGRESSION"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", c.name, formatSamples(c.old), formatSamples(c.new), delta, note)
+	}
+	return tw.Flush()
+}
+
+// formatSamples returns the mean and the relative standard deviation.
+func formatSamples(s []float64) string {
+	m := mean(s)
+	if m == 0 {
+		return round(0).String()
+	}
+	return fmt.Sprintf("%s ±%.0f%%", round(time.Duration(m)), stddev(s)/m*100)
+}
+
+func mean(s []float64) float64 {
+	if len(s) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range s {
+		sum += v
+	}
+	return sum / float64(len(s))
+}
+
+func stddev(s []float64) float64 {
+	if len(s) < 2 {
+		return 0
+	}
+	m := mean(s)
+	var sum float64
+	for _, v := range s {
+		sum += (v - m) * (v - m)
+	}
+	return math.Sqrt(sum / float64(len(s)-1))
+}
+
+// mannWhitneyU returns the two-sided p-value of the Mann-Whitney U test that
+// a and b come from the same distribution. It uses the normal approximation
+// with tie and continuity correction, so it needs a handful of samples on
+// each side to mean much.
+func mannWhitneyU(a, b []float64) float64 {
+	n1, n2 := len(a), len(b)
+	if n1 == 0 || n2 == 0 {
+		return 1
+	}
+
+	type sample struct {
+		v     float64
+		fromA bool
+	}
+	all := make([]sample, 0, n1+n2)
+	for _, v := range a {
+		all = append(all, sample{v, true})
+	}
+	for _, v := range b {
+		all = append(all, sample{v, false})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].v < all[j].v })
+
+	// Rank the samples, ties get the average of their ranks.
+	var rankA, ties float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if all[k].fromA {
+				rankA += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+
+	n := float64(n1 + n2)
+	u := rankA - float64(n1*(n1+1))/2
+	mu := float64(n1*n2) / 2
+	sigma := math.Sqrt(float64(n1*n2) / 12 * ((n + 1) - ties/(n*(n-1))))
+	if sigma == 0 {
+		return 1
+	}
+
+	z := (math.Abs(u-mu) - 0.5) / sigma
+	if z < 0 {
+		z = 0
+	}
+	return math.Erfc(z / math.Sqrt2)
+}
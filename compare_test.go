@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMannWhitneyU(t *testing.T) {
+	// Expected values match scipy.stats.mannwhitneyu with the
+	// asymptotic method and continuity correction.
+	for _, tc := range []struct {
+		a, b     []float64
+		expected float64
+	}{
+		{[]float64{1, 2, 3, 4, 5}, []float64{6, 7, 8, 9, 10}, 0.01219},
+		{[]float64{1, 2, 2, 3, 4}, []float64{2, 3, 3, 5, 6}, 0.19883},
+		{[]float64{1, 1, 1}, []float64{1, 1, 1}, 1},
+	} {
+		if p := mannWhitneyU(tc.a, tc.b); math.Abs(p-tc.expected) > 0.0005 {
+			t.Fatalf("expected p=%f for %v vs %v, got %f", tc.expected, tc.a, tc.b, p)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cni-benchmarks-compare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The old run is written as json, the new one as csv. Setup gets 50%
+	// slower, remove stays the same.
+	write := func(name, format string, setup time.Duration) string {
+		path := filepath.Join(dir, name)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		w, err := newReportWriter(format, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			jitter := time.Duration(i) * time.Millisecond
+			if err := w.Write(&record{
+				Plugin:    "bridge",
+				Iteration: i,
+				Timings: timings{
+					SetupNetNS: setup + jitter,
+					Remove:     50*time.Millisecond + jitter,
+				},
+				Readiness: &readiness{FirstPacket: setup + jitter},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	oldPath := write("old.json", outputJSON, 100*time.Millisecond)
+	newPath := write("new.csv", outputCSV, 150*time.Millisecond)
+
+	var out strings.Builder
+	if err := runCompare([]string{"-phases", "remove", oldPath, newPath}, &out); err != nil {
+		t.Fatalf("expected no regression for remove, got %v:\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "bridge remove") || !strings.Contains(out.String(), "~") {
+		t.Fatalf("expected an insignificant remove delta, got:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := runCompare([]string{oldPath, newPath}, &out); err != errRegression {
+		t.Fatalf("expected a regression, got %v:\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "REGRESSION") {
+		t.Fatalf("expected the regression to be marked, got:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "bridge firstPacket") {
+		t.Fatalf("expected the first packet to be compared, got:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := runCompare([]string{"-threshold", "60", oldPath, newPath}, &out); err != nil {
+		t.Fatalf("expected no regression above the threshold, got %v:\n%s", err, out.String())
+	}
+}
+
+func TestCompareOldPhaseNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cni-benchmarks-compare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Reports written before createNetNS was called createProcess.
+	oldJSON, oldCSV := "", "plugin,iteration,createProcess,setupNetNS,remove,error\n"
+	for i := 0; i < 10; i++ {
+		ns := (10 + i) * int(time.Millisecond)
+		oldJSON += fmt.Sprintf(`{"plugin":"bridge","iteration":%d,"timings":{"createProcess":%d,"setupNetNS":1,"remove":1}}`+"\n", i, ns)
+		oldCSV += fmt.Sprintf("bridge,%d,%d,1,1,\n", i, ns)
+	}
+	for name, data := range map[string]string{"old.json": oldJSON, "old.csv": oldCSV} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out strings.Builder
+	if err := runCompare([]string{"-phases", "createNetNS", filepath.Join(dir, "old.json"), filepath.Join(dir, "old.csv")}, &out); err != nil {
+		t.Fatalf("expected no regression, got %v:\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "bridge createNetNS") {
+		t.Fatalf("expected createProcess to be compared as createNetNS, got:\n%s", out.String())
+	}
+}
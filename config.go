@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/libcni"
+)
+
+const (
+	confExt     = ".conf"
+	confListExt = ".conflist"
+)
+
+// pluginName returns the name of the plugin configured in a file in the
+// configuration directory, or nothing if it is not a configuration.
+func pluginName(file string) string {
+	base := filepath.Base(file)
+	for _, ext := range []string{confListExt, confExt} {
+		if strings.HasSuffix(base, ext) {
+			return strings.TrimSuffix(base, ext)
+		}
+	}
+	return ""
+}
+
+// plugins walks the configuration directory and returns the names of all the
+// configurations.
+func (b *benchmarkCNI) plugins() ([]string, error) {
+	plugins := []string{}
+	if err := filepath.Walk(b.pluginConfDir, func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if f.IsDir() {
+			// Skip directories.
+			return nil
+		}
+
+		if name := pluginName(p); name != "" {
+			plugins = append(plugins, name)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("walking plugin configuration directory %s failed: %v", b.pluginConfDir, err)
+	}
+	return plugins, nil
+}
+
+// confFile returns the configuration file of a plugin, a .conflist wins over
+// a .conf and a rendered configuration over both.
+func (b *benchmarkCNI) confFile(plugin string) string {
+	if file, ok := b.rendered[plugin]; ok {
+		return file
+	}
+	list := filepath.Join(b.pluginConfDir, plugin+confListExt)
+	if _, err := os.Stat(list); err == nil {
+		return list
+	}
+	return filepath.Join(b.pluginConfDir, plugin+confExt)
+}
+
+// confList reads the configuration of a plugin, a single configuration is
+// turned into a list of one.
+func (b *benchmarkCNI) confList(plugin string) (*libcni.NetworkConfigList, error) {
+	file := b.confFile(plugin)
+	if strings.HasSuffix(file, confListExt) {
+		list, err := libcni.ConfListFromFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading configuration of %s failed: %v", plugin, err)
+		}
+		return list, nil
+	}
+
+	conf, err := libcni.ConfFromFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading configuration of %s failed: %v", plugin, err)
+	}
+	list, err := libcni.ConfListFromConf(conf)
+	if err != nil {
+		return nil, fmt.Errorf("reading configuration of %s failed: %v", plugin, err)
+	}
+	return list, nil
+}
+
+// pluginTypes returns the types of the plugins in the configuration of a
+// plugin, in the order they are chained.
+func (b *benchmarkCNI) pluginTypes(plugin string) ([]string, error) {
+	list, err := b.confList(plugin)
+	if err != nil {
+		return nil, err
+	}
+	types := []string{}
+	for _, p := range list.Plugins {
+		types = append(types, p.Network.Type)
+	}
+	return types, nil
+}
+
+// ipamDirs returns the IPAM data directories of a plugin configuration, for
+// the plugins in it that use host-local.
+func (b *benchmarkCNI) ipamDirs(plugin string) ([]string, error) {
+	list, err := b.confList(plugin)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := []string{}
+	for _, p := range list.Plugins {
+		var conf struct {
+			IPAM struct {
+				Type    string `json:"type"`
+				DataDir string `json:"dataDir"`
+			} `json:"ipam"`
+		}
+		if err := json.Unmarshal(p.Bytes, &conf); err != nil {
+			return nil, fmt.Errorf("parsing configuration of %s failed: %v", plugin, err)
+		}
+
+		switch {
+		case conf.IPAM.DataDir != "":
+			dirs = append(dirs, filepath.Join(conf.IPAM.DataDir, list.Name))
+		case conf.IPAM.Type == "host-local":
+			dirs = append(dirs, filepath.Join(defaultIPAMDataDir, list.Name))
+		}
+	}
+	return dirs, nil
+}
+
+// render writes the configuration of a plugin, changed by edit, to a
+// temporary file that replaces it from then on. Rendering again edits the
+// rendered configuration.
+func (b *benchmarkCNI) render(plugin string, edit func(conf map[string]interface{}) error) error {
+	file := b.confFile(plugin)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("reading configuration of %s failed: %v", plugin, err)
+	}
+	conf := map[string]interface{}{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return fmt.Errorf("decoding configuration of %s failed: %v", plugin, err)
+	}
+	if err := edit(conf); err != nil {
+		return fmt.Errorf("rendering configuration of %s failed: %v", plugin, err)
+	}
+	if data, err = json.MarshalIndent(conf, "", "    "); err != nil {
+		return fmt.Errorf("encoding configuration of %s failed: %v", plugin, err)
+	}
+	return b.writeRendered(plugin, filepath.Ext(file), data)
+}
+
+// writeRendered writes a rendered configuration of a plugin, with the
+// extension of the file it replaces.
+func (b *benchmarkCNI) writeRendered(plugin, ext string, data []byte) error {
+	dir, err := b.renderDirectory()
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, plugin+"-*"+ext)
+	if err != nil {
+		return fmt.Errorf("creating rendered configuration of %s failed: %v", plugin, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("writing rendered configuration of %s failed: %v", plugin, err)
+	}
+	b.rendered[plugin] = f.Name()
+	return nil
+}
+
+// renderDirectory returns the directory for rendered configurations and the
+// files they refer to, creating it the first time.
+func (b *benchmarkCNI) renderDirectory() (string, error) {
+	if b.renderDir == "" {
+		dir, err := ioutil.TempDir("", "cni-benchmarks-net.d")
+		if err != nil {
+			return "", fmt.Errorf("creating directory for the rendered configurations failed: %v", err)
+		}
+		b.renderDir = dir
+	}
+	return b.renderDir, nil
+}
+
+// removeRendered removes the rendered configurations.
+func (b *benchmarkCNI) removeRendered() error {
+	if b.renderDir == "" {
+		return nil
+	}
+	return os.RemoveAll(b.renderDir)
+}
+
+// pluginConfs returns the configurations of the plugins in a configuration,
+// the configuration itself if it is not a list.
+func pluginConfs(conf map[string]interface{}) []map[string]interface{} {
+	list, ok := conf["plugins"].([]interface{})
+	if !ok {
+		return []map[string]interface{}{conf}
+	}
+	confs := []map[string]interface{}{}
+	for _, p := range list {
+		if c, ok := p.(map[string]interface{}); ok {
+			confs = append(confs, c)
+		}
+	}
+	return confs
+}
+
+// renderedConfig returns the rendered configuration of a plugin, compacted,
+// or nothing if it runs the one in the configuration directory.
+func (b *benchmarkCNI) renderedConfig(plugin string) (json.RawMessage, error) {
+	file, ok := b.rendered[plugin]
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading rendered configuration of %s failed: %v", plugin, err)
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return nil, fmt.Errorf("compacting rendered configuration of %s failed: %v", plugin, err)
+	}
+	return buf.Bytes(), nil
+}
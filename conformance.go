@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/sirupsen/logrus"
+)
+
+// errNonConformant is returned by the conformance command when a plugin
+// failed a case.
+var errNonConformant = fmt.Errorf("found plugins that do not conform to the CNI spec")
+
+// unparsedErrorPrefix is how libcni reports a plugin error that is not a JSON
+// error object.
+const unparsedErrorPrefix = "netplugin failed but error parsing its diagnostic message"
+
+// conformanceResult is the outcome of one conformance case for a plugin.
+type conformanceResult struct {
+	Case   string `json:"case"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+// conformanceCase is one edge case of the CNI spec.
+type conformanceCase struct {
+	name string
+	run  func(c *conformance) error
+}
+
+var conformanceCases = []conformanceCase{
+	{"del-twice", (*conformance).delTwice},
+	{"del-without-add", (*conformance).delWithoutAdd},
+	{"del-netns-gone", (*conformance).delNetNSGone},
+	{"add-twice", (*conformance).addTwice},
+	{"version", (*conformance).version},
+	{"error-json", (*conformance).errorJSON},
+	{"unknown-args", (*conformance).unknownArgs},
+}
+
+// conformance runs the cases against the configuration of one plugin with
+// libcni directly, so the loopback network go-cni adds is left out.
+type conformance struct {
+	b      *benchmarkCNI
+	plugin string
+	list   *libcni.NetworkConfigList
+	cni    *libcni.CNIConfig
+}
+
+// runConformance implements the conformance command, it runs every case
+// against every plugin.
+func (b *benchmarkCNI) runConformance(plugins []string, write func(*record), w io.Writer) error {
+	b.doLog = debug
+
+	failed := false
+	tw := tabwriter.NewWriter(w, 10, 1, 3, ' ', 0)
+	fmt.Fprintln(tw, "PLUGIN\tCASE\tRESULT\tERROR")
+	for _, plugin := range plugins {
+		r := &record{Plugin: plugin}
+		list, err := b.confList(plugin)
+		if err != nil {
+			r.fail(err)
+			logrus.WithFields(logrus.Fields{"plugin": plugin}).Error(err)
+			write(r)
+			failed = true
+			continue
+		}
+		c := &conformance{b: b, plugin: plugin, list: list, cni: &libcni.CNIConfig{Path: b.pluginDirs}}
+
+		for _, cc := range conformanceCases {
+			logrus.WithFields(logrus.Fields{"plugin": plugin, "case": cc.name}).Info("running conformance case")
+			res := &conformanceResult{Case: cc.name, Passed: true}
+			result := "pass"
+			if err := cc.run(c); err != nil {
+				res.Passed, res.Error = false, err.Error()
+				result = "FAIL"
+				r.fail(fmt.Errorf("%s: %v", cc.name, err))
+				failed = true
+			}
+			r.Conformance = append(r.Conformance, res)
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", plugin, cc.name, result, res.Error)
+		}
+		write(r)
+	}
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("printing conformance results failed: %v", err)
+	}
+
+	if failed {
+		return errNonConformant
+	}
+	return nil
+}
+
+// runtimeConf returns the runtime configuration for a pod.
+func (c *conformance) runtimeConf(p *pod, args ...[2]string) *libcni.RuntimeConf {
+	return &libcni.RuntimeConf{
+		ContainerID: p.id(),
+		NetNS:       p.netnsFD,
+		IfName:      "eth0",
+		Args:        args,
+	}
+}
+
+// newPod creates a pod for a case.
+func (c *conformance) newPod() (*pod, error) {
+	return c.b.createPod(c.plugin)
+}
+
+func (c *conformance) delTwice() error {
+	p, err := c.newPod()
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	rt := c.runtimeConf(p)
+	if _, err := c.cni.AddNetworkList(c.list, rt); err != nil {
+		c.cni.DelNetworkList(c.list, rt)
+		return fmt.Errorf("ADD failed: %v", err)
+	}
+	if err := c.cni.DelNetworkList(c.list, rt); err != nil {
+		return fmt.Errorf("first DEL failed: %v", err)
+	}
+	if err := c.cni.DelNetworkList(c.list, rt); err != nil {
+		return fmt.Errorf("second DEL failed: %v", err)
+	}
+	return nil
+}
+
+func (c *conformance) delWithoutAdd() error {
+	p, err := c.newPod()
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	if err := c.cni.DelNetworkList(c.list, c.runtimeConf(p)); err != nil {
+		return fmt.Errorf("DEL without ADD failed: %v", err)
+	}
+	return nil
+}
+
+func (c *conformance) delNetNSGone() error {
+	p, err := c.newPod()
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	rt := c.runtimeConf(p)
+	if _, err := c.cni.AddNetworkList(c.list, rt); err != nil {
+		c.cni.DelNetworkList(c.list, rt)
+		return fmt.Errorf("ADD failed: %v", err)
+	}
+	// The runtime may only get to DEL after the pod is gone.
+	if err := p.Close(); err != nil {
+		return fmt.Errorf("destroying the netns failed: %v", err)
+	}
+	if err := c.cni.DelNetworkList(c.list, rt); err != nil {
+		return fmt.Errorf("DEL after the netns is gone failed: %v", err)
+	}
+	return nil
+}
+
+func (c *conformance) addTwice() error {
+	p, err := c.newPod()
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	rt := c.runtimeConf(p)
+	first, err := c.cni.AddNetworkList(c.list, rt)
+	if err != nil {
+		c.cni.DelNetworkList(c.list, rt)
+		return fmt.Errorf("ADD failed: %v", err)
+	}
+
+	// The spec leaves a repeated ADD undefined, but it must either fail
+	// cleanly or hand out the same addresses.
+	var failed error
+	second, err := c.cni.AddNetworkList(c.list, rt)
+	if err != nil {
+		if err := wellFormedError(err); err != nil {
+			failed = fmt.Errorf("second ADD: %v", err)
+		}
+	} else if before, after := resultIPs(first), resultIPs(second); before != after {
+		failed = fmt.Errorf("second ADD returned %s, the first %s", after, before)
+	}
+
+	// The runtime cleans up with DEL whether the second ADD failed or not.
+	if err := c.cni.DelNetworkList(c.list, rt); err != nil && failed == nil {
+		failed = fmt.Errorf("DEL after the second ADD failed: %v", err)
+	}
+	return failed
+}
+
+func (c *conformance) version() error {
+	want := c.list.CNIVersion
+	if want == "" {
+		want = "0.1.0"
+	}
+	for _, plugin := range c.list.Plugins {
+		info, err := c.cni.GetVersionInfo(plugin.Network.Type)
+		if err != nil {
+			return fmt.Errorf("VERSION of %s failed: %v", plugin.Network.Type, err)
+		}
+		supported := info.SupportedVersions()
+		if !contains(supported, want) {
+			return fmt.Errorf("%s does not support cniVersion %s, only %s", plugin.Network.Type, want, strings.Join(supported, ", "))
+		}
+	}
+	return nil
+}
+
+func (c *conformance) errorJSON() error {
+	// Every plugin has to fail an ADD into a network namespace that does
+	// not exist.
+	rt := &libcni.RuntimeConf{
+		ContainerID: "cni-benchmarks-conformance",
+		NetNS:       filepath.Join(os.TempDir(), "cni-benchmarks-no-such-netns"),
+		IfName:      "eth0",
+	}
+	_, err := c.cni.AddNetworkList(c.list, rt)
+	if err == nil {
+		c.cni.DelNetworkList(c.list, rt)
+		return fmt.Errorf("ADD into %s succeeded", rt.NetNS)
+	}
+	return wellFormedError(err)
+}
+
+func (c *conformance) unknownArgs() error {
+	p, err := c.newPod()
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	// Without IgnoreUnknown a plugin may refuse arguments it does not
+	// know, but it has to say so properly. Either way the runtime follows
+	// up with DEL, a plugin may have created devices before refusing.
+	unknown := [2]string{"CNI_BENCHMARKS_UNKNOWN", "1"}
+	rt := c.runtimeConf(p, unknown)
+	if _, err := c.cni.AddNetworkList(c.list, rt); err != nil {
+		if err := wellFormedError(err); err != nil {
+			c.cni.DelNetworkList(c.list, rt)
+			return fmt.Errorf("ADD with an unknown argument: %v", err)
+		}
+		// The DEL may refuse the argument the same way.
+		if err := c.cni.DelNetworkList(c.list, rt); err != nil {
+			if err := wellFormedError(err); err != nil {
+				return fmt.Errorf("DEL after refusing an unknown argument: %v", err)
+			}
+		}
+	} else if err := c.cni.DelNetworkList(c.list, rt); err != nil {
+		return fmt.Errorf("DEL with an unknown argument failed: %v", err)
+	}
+
+	// With it, it must not. A fresh pod leaves nothing of the first ADD
+	// in the way.
+	p, err = c.newPod()
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	rt = c.runtimeConf(p, [2]string{"IgnoreUnknown", "1"}, unknown)
+	if _, err := c.cni.AddNetworkList(c.list, rt); err != nil {
+		return fmt.Errorf("ADD with IgnoreUnknown=1 and an unknown argument failed: %v", err)
+	}
+	if err := c.cni.DelNetworkList(c.list, rt); err != nil {
+		return fmt.Errorf("DEL with IgnoreUnknown=1 and an unknown argument failed: %v", err)
+	}
+	return nil
+}
+
+// wellFormedError checks a plugin failed with a JSON error object that has a
+// code and a message.
+func wellFormedError(err error) error {
+	e, ok := err.(*types.Error)
+	if !ok {
+		return fmt.Errorf("plugin could not be executed: %v", err)
+	}
+	if strings.HasPrefix(e.Msg, unparsedErrorPrefix) {
+		return fmt.Errorf("error is not a JSON object: %s", e.Msg)
+	}
+	if e.Code == 0 {
+		return fmt.Errorf("error has no code: %s", e.Msg)
+	}
+	if e.Msg == "" {
+		return fmt.Errorf("error %d has no message", e.Code)
+	}
+	return nil
+}
+
+// resultIPs returns the addresses in a result, for comparing results.
+func resultIPs(result types.Result) string {
+	r, err := current.NewResultFromResult(result)
+	if err != nil {
+		return fmt.Sprintf("an unreadable result (%v)", err)
+	}
+	ips := []string{}
+	for _, c := range r.IPs {
+		ips = append(ips, c.Address.String())
+	}
+	if len(ips) == 0 {
+		return "no addresses"
+	}
+	return strings.Join(ips, ", ")
+}
+
+// contains reports whether s is in list.
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// conformanceString formats conformance results for the CSV report.
+func conformanceString(results []*conformanceResult) string {
+	cases := []string{}
+	for _, res := range results {
+		result := "pass"
+		if !res.Passed {
+			result = "fail"
+		}
+		cases = append(cases, res.Case+"="+result)
+	}
+	return strings.Join(cases, ";")
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestWellFormedError(t *testing.T) {
+	testCases := []struct {
+		err  error
+		good bool
+	}{
+		{err: &types.Error{Code: 7, Msg: "invalid config"}, good: true},
+		{err: &types.Error{Msg: "no code"}},
+		{err: &types.Error{Code: 7}},
+		{err: &types.Error{Msg: unparsedErrorPrefix + ` "panic: oops": invalid character`}},
+		{err: fmt.Errorf("fork/exec: permission denied")},
+	}
+	for _, tc := range testCases {
+		if err := wellFormedError(tc.err); (err == nil) != tc.good {
+			t.Errorf("wellFormedError(%v): expected well-formed %t, got %v", tc.err, tc.good, err)
+		}
+	}
+}
+
+func TestConformanceString(t *testing.T) {
+	results := []*conformanceResult{
+		{Case: "del-twice", Passed: true},
+		{Case: "version", Error: "boom"},
+	}
+	expected := "del-twice=pass;version=fail"
+	if got := conformanceString(results); got != expected {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	cni "github.com/containerd/go-cni"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	// udpPayloadSize is small so the packet rate measures the per packet
+	// cost of the path rather than its bandwidth.
+	udpPayloadSize = 64
+	// udpDrainTime is how long the receiver keeps counting packets after
+	// the sender stopped.
+	udpDrainTime = 100 * time.Millisecond
+
+	dataPlaneTimeout = 2 * time.Second
+)
+
+// Paths the data-plane traffic is measured on.
+const (
+	pathPodToPod  = "pod-pod"
+	pathPodToHost = "pod-host"
+)
+
+// endpoint is one side of the data-plane traffic, a pod or the host when pod
+// is nil.
+type endpoint struct {
+	pod *pod
+	ip  net.IP
+}
+
+// dataPlaneResult holds the traffic measured from the pod to a second pod on
+// the same network and from the pod to the host.
+type dataPlaneResult struct {
+	PodToPod  *trafficResult `json:"podToPod,omitempty"`
+	PodToHost *trafficResult `json:"podToHost,omitempty"`
+}
+
+// trafficResult is what the traffic generator measured on one path. A path
+// that did not work only has its error, the plugin may not support it.
+type trafficResult struct {
+	// TCPThroughput is in bits per second.
+	TCPThroughput float64 `json:"tcpThroughput"`
+	// UDPPacketRate is how many small packets per second got through,
+	// UDPLoss the fraction of the packets sent that did not.
+	UDPPacketRate float64 `json:"udpPacketRate"`
+	UDPLoss       float64 `json:"udpLoss"`
+	// Latency percentiles of one byte requests and responses over a TCP
+	// connection.
+	LatencyP50 time.Duration `json:"latencyP50"`
+	LatencyP90 time.Duration `json:"latencyP90"`
+	LatencyP99 time.Duration `json:"latencyP99"`
+	// ConnectionRate is how many TCP connections per second were opened
+	// and closed.
+	ConnectionRate float64 `json:"connectionRate"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// measureDataPlane attaches a second pod to the network of plugin and runs
+// the traffic generator from the pod to it and from the pod to the host.
+func (b *benchmarkCNI) measureDataPlane(plugin string, p *pod, result *cni.CNIResult) (*dataPlaneResult, error) {
+	ipConfig, err := primaryIPConfig(result)
+	if err != nil {
+		return nil, err
+	}
+	src := endpoint{pod: p, ip: ipConfig.IP}
+
+	peer, err := b.createPod(plugin)
+	if err != nil {
+		return nil, fmt.Errorf("creating peer pod failed: %v", err)
+	}
+	defer peer.Close()
+	peerResult, err := b.setupNetNS(peer)
+	if err != nil {
+		return nil, fmt.Errorf("attaching peer pod failed: %v", err)
+	}
+
+	dp := &dataPlaneResult{}
+	if peerConfig, err := primaryIPConfig(peerResult); err == nil {
+		dp.PodToPod = b.measureTraffic(src, endpoint{pod: peer, ip: peerConfig.IP})
+	} else {
+		dp.PodToPod = &trafficResult{Error: "peer pod: " + err.Error()}
+	}
+	b.log(plugin, "data plane %s: %s", pathPodToPod, dp.PodToPod)
+
+	// The gateway is an address on the host for bridge and ptp, other
+	// plugins might not route to the host at all.
+	if gw := ipConfig.Gateway; gw != nil {
+		dp.PodToHost = b.measureTraffic(src, endpoint{ip: gw})
+	} else {
+		dp.PodToHost = &trafficResult{Error: "result has no gateway to reach the host on"}
+	}
+	b.log(plugin, "data plane %s: %s", pathPodToHost, dp.PodToHost)
+
+	for path, t := range map[string]*trafficResult{pathPodToPod: dp.PodToPod, pathPodToHost: dp.PodToHost} {
+		if t.Error != "" {
+			logrus.WithFields(logrus.Fields{"plugin": plugin, "path": path}).Warn(t.Error)
+		}
+	}
+
+	// Detach the peer before the DEL of the pod, so the leak check does not
+	// count it.
+	if err := b.removeNetNS(peer); err != nil {
+		return dp, fmt.Errorf("detaching peer pod failed: %v", err)
+	}
+	return dp, nil
+}
+
+func (t *trafficResult) String() string {
+	if t.Error != "" {
+		return t.Error
+	}
+	return fmt.Sprintf("tcp %s, udp %.0f pps (%.1f%% loss), rr p50 %s p99 %s, %.0f conn/s",
+		formatRate(t.TCPThroughput), t.UDPPacketRate, t.UDPLoss*100,
+		round(t.LatencyP50), round(t.LatencyP99), t.ConnectionRate)
+}
+
+// measureTraffic runs every traffic test from one endpoint to the other, for
+// -dataplane each, stopping at the first that fails.
+func (b *benchmarkCNI) measureTraffic(from, to endpoint) *trafficResult {
+	t := &trafficResult{}
+	fail := func(what string, err error) *trafficResult {
+		t.Error = fmt.Sprintf("measuring %s to %s failed: %v", what, to.ip, err)
+		return t
+	}
+
+	var err error
+	if t.TCPThroughput, err = b.tcpThroughput(from, to, dataPlane); err != nil {
+		return fail("tcp throughput", err)
+	}
+	if t.UDPPacketRate, t.UDPLoss, err = b.udpPacketRate(from, to, dataPlane); err != nil {
+		return fail("udp packet rate", err)
+	}
+	h, err := b.requestLatency(from, to, dataPlane)
+	if err != nil {
+		return fail("request latency", err)
+	}
+	t.LatencyP50, t.LatencyP90, t.LatencyP99 = h.Percentile(50), h.Percentile(90), h.Percentile(99)
+	if t.ConnectionRate, err = b.connectionRate(from, to, dataPlane); err != nil {
+		return fail("connection rate", err)
+	}
+	return t
+}
+
+// inNS runs fn in the network namespace of e, sockets it creates belong to
+// that namespace.
+func (b *benchmarkCNI) inNS(e endpoint, fn func() error) error {
+	if e.pod == nil {
+		return fn()
+	}
+	if err := e.pod.setNS(); err != nil {
+		return err
+	}
+	err := fn()
+	if err := netns.Set(b.originalNS); err != nil {
+		return fmt.Errorf("returning to original namespace failed: %v", err)
+	}
+	return err
+}
+
+// listenTCP listens on a free port of the endpoint.
+func (b *benchmarkCNI) listenTCP(e endpoint) (net.Listener, error) {
+	var l net.Listener
+	if err := b.inNS(e, func() (err error) {
+		l, err = net.Listen("tcp", net.JoinHostPort(e.ip.String(), "0"))
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("listening on %s failed: %v", e.ip, err)
+	}
+	return l, nil
+}
+
+// dialTCP connects from an endpoint to a listener.
+func (b *benchmarkCNI) dialTCP(e endpoint, l net.Listener) (net.Conn, error) {
+	var c net.Conn
+	if err := b.inNS(e, func() (err error) {
+		c, err = net.DialTimeout("tcp", l.Addr().String(), dataPlaneTimeout)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("dialing %s failed: %v", l.Addr(), err)
+	}
+	return c, nil
+}
+
+// tcpThroughput sends as much as it can over one connection for d and
+// returns the bits per second the receiver got.
+func (b *benchmarkCNI) tcpThroughput(from, to endpoint, d time.Duration) (float64, error) {
+	l, err := b.listenTCP(to)
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+
+	received := make(chan float64, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			received <- 0
+			return
+		}
+		defer c.Close()
+		start := time.Now()
+		n, _ := io.Copy(ioutil.Discard, c)
+		received <- float64(n*8) / time.Since(start).Seconds()
+	}()
+
+	c, err := b.dialTCP(from, l)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 32*1024)
+	c.SetWriteDeadline(time.Now().Add(d))
+	for {
+		if _, err := c.Write(buf); err != nil {
+			break
+		}
+	}
+	// Reset the connection instead of waiting for what is still queued,
+	// the receiver only counts what arrived while sending.
+	c.(*net.TCPConn).SetLinger(0)
+	c.Close()
+
+	select {
+	case bps := <-received:
+		return bps, nil
+	case <-time.After(dataPlaneTimeout):
+		return 0, fmt.Errorf("the receiver did not finish")
+	}
+}
+
+// udpPacketRate sends small packets as fast as it can for d and returns how
+// many per second arrived and the fraction that got lost.
+func (b *benchmarkCNI) udpPacketRate(from, to endpoint, d time.Duration) (float64, float64, error) {
+	var server net.PacketConn
+	if err := b.inNS(to, func() (err error) {
+		server, err = net.ListenPacket("udp", net.JoinHostPort(to.ip.String(), "0"))
+		return err
+	}); err != nil {
+		return 0, 0, fmt.Errorf("listening on %s failed: %v", to.ip, err)
+	}
+	defer server.Close()
+
+	var received int64
+	go func() {
+		buf := make([]byte, udpPayloadSize)
+		for {
+			if _, _, err := server.ReadFrom(buf); err != nil {
+				return
+			}
+			atomic.AddInt64(&received, 1)
+		}
+	}()
+
+	var c net.Conn
+	if err := b.inNS(from, func() (err error) {
+		c, err = net.Dial("udp", server.LocalAddr().String())
+		return err
+	}); err != nil {
+		return 0, 0, fmt.Errorf("dialing %s failed: %v", server.LocalAddr(), err)
+	}
+	defer c.Close()
+
+	var sent int64
+	buf := make([]byte, udpPayloadSize)
+	start := time.Now()
+	for time.Since(start) < d {
+		// Full socket buffers and ICMP errors show up as loss.
+		if _, err := c.Write(buf); err == nil {
+			sent++
+		}
+	}
+	time.Sleep(udpDrainTime)
+
+	got := atomic.LoadInt64(&received)
+	if got == 0 {
+		return 0, 1, fmt.Errorf("none of the %d packets arrived", sent)
+	}
+	return float64(got) / d.Seconds(), 1 - float64(got)/float64(sent), nil
+}
+
+// requestLatency sends one byte requests over a connection and waits for the
+// byte to be echoed back, one at a time for d.
+func (b *benchmarkCNI) requestLatency(from, to endpoint, d time.Duration) (*histogram, error) {
+	l, err := b.listenTCP(to)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	c, err := b.dialTCP(from, l)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	h := newHistogram()
+	buf := []byte{0}
+	end := time.Now().Add(d)
+	c.SetDeadline(end.Add(dataPlaneTimeout))
+	for time.Now().Before(end) {
+		start := time.Now()
+		if _, err := c.Write(buf); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return nil, err
+		}
+		h.Record(time.Since(start))
+	}
+	return h, nil
+}
+
+// connectionRate opens and closes connections one after the other for d and
+// returns how many per second it managed.
+func (b *benchmarkCNI) connectionRate(from, to endpoint, d time.Duration) (float64, error) {
+	l, err := b.listenTCP(to)
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// Closing first leaves TIME_WAIT on the listening side, so the
+			// client does not run out of ports.
+			c.Close()
+		}
+	}()
+
+	var n int
+	start := time.Now()
+	if err := b.inNS(from, func() error {
+		buf := make([]byte, 1)
+		for time.Since(start) < d {
+			c, err := net.DialTimeout("tcp", l.Addr().String(), dataPlaneTimeout)
+			if err != nil {
+				return fmt.Errorf("dialing %s failed: %v", l.Addr(), err)
+			}
+			// Wait for the listener to close.
+			c.SetReadDeadline(time.Now().Add(dataPlaneTimeout))
+			c.Read(buf)
+			c.Close()
+			n++
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return float64(n) / time.Since(start).Seconds(), nil
+}
+
+// trafficTotals sums the traffic results of a path over the iterations of a
+// plugin.
+type trafficTotals struct {
+	n        int
+	failures int
+	total    trafficResult
+}
+
+func (t *trafficTotals) record(r *trafficResult) {
+	if r == nil {
+		return
+	}
+	if r.Error != "" {
+		t.failures++
+		return
+	}
+	t.n++
+	t.total.TCPThroughput += r.TCPThroughput
+	t.total.UDPPacketRate += r.UDPPacketRate
+	t.total.UDPLoss += r.UDPLoss
+	t.total.LatencyP50 += r.LatencyP50
+	t.total.LatencyP90 += r.LatencyP90
+	t.total.LatencyP99 += r.LatencyP99
+	t.total.ConnectionRate += r.ConnectionRate
+}
+
+// mean returns the mean of every measurement.
+func (t *trafficTotals) mean() trafficResult {
+	if t.n == 0 {
+		return trafficResult{}
+	}
+	n := float64(t.n)
+	return trafficResult{
+		TCPThroughput:  t.total.TCPThroughput / n,
+		UDPPacketRate:  t.total.UDPPacketRate / n,
+		UDPLoss:        t.total.UDPLoss / n,
+		LatencyP50:     t.total.LatencyP50 / time.Duration(t.n),
+		LatencyP90:     t.total.LatencyP90 / time.Duration(t.n),
+		LatencyP99:     t.total.LatencyP99 / time.Duration(t.n),
+		ConnectionRate: t.total.ConnectionRate / n,
+	}
+}
+
+// printDataPlane writes a table of the mean data-plane measurements of every
+// plugin by path. The latency percentiles are the mean of the percentiles of
+// every iteration.
+func printDataPlane(w io.Writer, stats []*pluginStats) error {
+	tw := tabwriter.NewWriter(w, 10, 1, 3, ' ', 0)
+	fmt.Fprintln(tw, "PLUGIN\tPATH\tN\tFAILED\tTCP\tUDP PPS\tUDP LOSS\tRR P50\tRR P90\tRR P99\tCONN/S")
+	for _, s := range stats {
+		for _, path := range []struct {
+			name string
+			t    *trafficTotals
+		}{{pathPodToPod, &s.podToPod}, {pathPodToHost, &s.podToHost}} {
+			if path.t.n == 0 {
+				fmt.Fprintf(tw, "%s\t%s\t0\t%d\t\t\t\t\t\t\t\n", s.plugin, path.name, path.t.failures)
+				continue
+			}
+			m := path.t.mean()
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%.0f\t%.1f%%\t%s\t%s\t%s\t%.0f\n",
+				s.plugin, path.name, path.t.n, path.t.failures,
+				formatRate(m.TCPThroughput), m.UDPPacketRate, m.UDPLoss*100,
+				round(m.LatencyP50), round(m.LatencyP90), round(m.LatencyP99), m.ConnectionRate)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMeasureTrafficLoopback(t *testing.T) {
+	defer func(d time.Duration) { dataPlane = d }(dataPlane)
+	dataPlane = 50 * time.Millisecond
+
+	// Both endpoints in the host namespace, no pods needed.
+	b := &benchmarkCNI{}
+	lo := endpoint{ip: net.IPv4(127, 0, 0, 1)}
+	r := b.measureTraffic(lo, lo)
+	if r.Error != "" {
+		t.Fatal(r.Error)
+	}
+	if r.TCPThroughput <= 0 || r.UDPPacketRate <= 0 || r.ConnectionRate <= 0 {
+		t.Fatalf("expected traffic on loopback, got %+v", r)
+	}
+	if r.LatencyP50 <= 0 || r.LatencyP50 > r.LatencyP99 {
+		t.Fatalf("expected 0 < p50 <= p99, got %s and %s", r.LatencyP50, r.LatencyP99)
+	}
+}
+
+func TestTrafficTotals(t *testing.T) {
+	var totals trafficTotals
+	totals.record(&trafficResult{TCPThroughput: 1e9, UDPLoss: 0.1, LatencyP50: 10 * time.Microsecond, ConnectionRate: 100})
+	totals.record(&trafficResult{TCPThroughput: 3e9, UDPLoss: 0.3, LatencyP50: 30 * time.Microsecond, ConnectionRate: 300})
+	totals.record(&trafficResult{Error: "no route to host"})
+	totals.record(nil)
+
+	if totals.n != 2 || totals.failures != 1 {
+		t.Fatalf("expected 2 results and 1 failure, got %d and %d", totals.n, totals.failures)
+	}
+	m := totals.mean()
+	if m.TCPThroughput != 2e9 || m.LatencyP50 != 20*time.Microsecond || m.ConnectionRate != 200 {
+		t.Fatalf("expected the means, got %+v", m)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// prerequisiteTimeout bounds connecting to a daemon.
+	prerequisiteTimeout = time.Second
+
+	defaultFlannelSubnetFile = "/run/flannel/subnet.env"
+	ciliumSocket             = "/var/run/cilium/cilium.sock"
+	weaveSocket              = "/var/run/weave/weave.sock"
+)
+
+// pluginModules are the kernel modules the plugins create their devices
+// with.
+var pluginModules = map[string][]string{
+	"bandwidth":  {"ifb", "sch_tbf"},
+	"bridge":     {"bridge"},
+	"cilium-cni": {"vxlan"},
+	"flannel":    {"vxlan"},
+	"ipvlan":     {"ipvlan"},
+	"macvlan":    {"macvlan"},
+	"vlan":       {"8021q"},
+	"weave-net":  {"vxlan"},
+}
+
+// check is a prerequisite and what is wrong with it, if anything.
+type check struct {
+	name string
+	err  error
+}
+
+func (c check) String() string {
+	if c.err != nil {
+		return fmt.Sprintf("%s: %v", c.name, c.err)
+	}
+	return c.name + ": ok"
+}
+
+// inventory is what a configuration needs and what was found of it.
+type inventory struct {
+	plugin string
+	// types are the plugins the configuration executes, including IPAM
+	// plugins and delegates, in order.
+	types    []string
+	binaries []check
+	// path, versions and checksum are of the binary of the first plugin,
+	// if it was found.
+	path      string
+	versions  []string
+	checksum  string
+	modules   []check
+	daemons   []check
+	configErr error
+}
+
+// problems returns every prerequisite that is not met.
+func (inv *inventory) problems() []string {
+	problems := []string{}
+	if inv.configErr != nil {
+		problems = append(problems, inv.configErr.Error())
+	}
+	for _, checks := range [][]check{inv.binaries, inv.modules, inv.daemons} {
+		for _, c := range checks {
+			if c.err != nil {
+				problems = append(problems, c.String())
+			}
+		}
+	}
+	return problems
+}
+
+// unmetPrerequisites returns what a plugin needs to run that is missing:
+// binaries, kernel modules, daemons, and go-cni accepting its configuration.
+func (b *benchmarkCNI) unmetPrerequisites(plugin string) []string {
+	unmet := b.inventory(plugin).problems()
+	if len(unmet) > 0 {
+		return unmet
+	}
+	if err := b.loadCNIConfig(plugin); err != nil {
+		return []string{err.Error()}
+	}
+	if err := b.libcni.Status(); err != nil {
+		return []string{fmt.Sprintf("go-cni is not ready: %v", err)}
+	}
+	return nil
+}
+
+// runDoctor implements the list and doctor commands, it prints one line per
+// configuration with what it needs and whether that is there.
+func (b *benchmarkCNI) runDoctor(w io.Writer) error {
+	plugins, err := b.plugins()
+	if err != nil {
+		return err
+	}
+	if err := b.renderTemplates(plugins); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 10, 1, 3, ' ', 0)
+	fmt.Fprintln(tw, "CONFIG\tTYPE\tBINARY\tVERSIONS\tSHA256\tMODULES\tPREREQUISITES\tREADY")
+	for _, plugin := range plugins {
+		inv := b.inventory(plugin)
+
+		checks := []string{}
+		for _, c := range inv.daemons {
+			checks = append(checks, c.String())
+		}
+		modules := []string{}
+		for _, c := range inv.modules {
+			modules = append(modules, c.String())
+		}
+		ready := "yes"
+		if problems := inv.problems(); len(problems) > 0 {
+			ready = "no: " + strings.Join(problems, "; ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			plugin, orDash(strings.Join(inv.types, ",")), orDash(inv.path), orDash(strings.Join(inv.versions, ",")),
+			orDash(inv.checksum), orDash(strings.Join(modules, ", ")), orDash(strings.Join(checks, ", ")), ready)
+	}
+	return tw.Flush()
+}
+
+// inventory finds the binaries of a configuration and checks its kernel
+// modules and daemons.
+func (b *benchmarkCNI) inventory(plugin string) *inventory {
+	inv := &inventory{plugin: plugin}
+	list, err := b.confList(plugin)
+	if err != nil {
+		inv.configErr = err
+		return inv
+	}
+
+	c := &libcni.CNIConfig{Path: b.pluginDirs}
+	seen := map[string]bool{}
+	for _, conf := range list.Plugins {
+		raw := map[string]interface{}{}
+		if err := json.Unmarshal(conf.Bytes, &raw); err != nil {
+			inv.configErr = fmt.Errorf("decoding configuration of %s failed: %v", plugin, err)
+			return inv
+		}
+
+		for _, t := range executedTypes(raw) {
+			if seen[t] {
+				continue
+			}
+			seen[t] = true
+			inv.types = append(inv.types, t)
+
+			path, err := invoke.FindInPath(t, b.pluginDirs)
+			if err != nil {
+				err = fmt.Errorf("not found in %s", strings.Join(b.pluginDirs, ", "))
+			}
+			inv.binaries = append(inv.binaries, check{name: t, err: err})
+			if err == nil && len(inv.types) == 1 {
+				inv.path = path
+				inv.checksum, err = checksum(path)
+				if err != nil {
+					inv.binaries = append(inv.binaries, check{name: t + " checksum", err: err})
+				}
+				if info, err := c.GetVersionInfo(t); err != nil {
+					inv.binaries = append(inv.binaries, check{name: t + " VERSION", err: err})
+				} else {
+					inv.versions = info.SupportedVersions()
+				}
+			}
+
+			for _, m := range pluginModules[t] {
+				inv.modules = append(inv.modules, check{name: m, err: moduleAvailable(m)})
+			}
+		}
+		inv.daemons = append(inv.daemons, daemonChecks(conf.Network.Type, raw)...)
+	}
+	return inv
+}
+
+// executedTypes returns the plugin of a configuration, its IPAM plugin and
+// the plugin flannel delegates to.
+func executedTypes(raw map[string]interface{}) []string {
+	types := []string{}
+	t, _ := raw["type"].(string)
+	types = append(types, t)
+	if ipam, ok := raw["ipam"].(map[string]interface{}); ok {
+		if t, ok := ipam["type"].(string); ok && t != "" {
+			types = append(types, t)
+		}
+	}
+	if t == "flannel" {
+		delegate, _ := raw["delegate"].(map[string]interface{})
+		dt, _ := delegate["type"].(string)
+		if dt == "" {
+			dt = "bridge"
+		}
+		// Flannel hands its delegate host-local IPAM.
+		types = append(types, dt, "host-local")
+	}
+	return types
+}
+
+// daemonChecks checks what a plugin needs outside of its binary: daemons,
+// the files they write and the master interface.
+func daemonChecks(pluginType string, raw map[string]interface{}) []check {
+	checks := []check{}
+	switch pluginType {
+	case "calico":
+		if endpoints, ok := raw["etcd_endpoints"].(string); ok && endpoints != "" {
+			for _, e := range strings.Split(endpoints, ",") {
+				checks = append(checks, check{name: "etcd " + e, err: dialEndpoint(e)})
+			}
+		}
+	case "flannel":
+		file, _ := raw["subnetFile"].(string)
+		if file == "" {
+			file = defaultFlannelSubnetFile
+		}
+		var err error
+		if _, serr := os.Stat(file); serr != nil {
+			err = fmt.Errorf("missing")
+		}
+		checks = append(checks, check{name: file, err: err})
+	case "cilium-cni":
+		checks = append(checks, check{name: ciliumSocket, err: dialSocket(ciliumSocket)})
+	case "weave-net":
+		checks = append(checks, check{name: weaveSocket, err: dialSocket(weaveSocket)})
+	}
+
+	// The master interface is in the configuration or, for flannel, in
+	// its delegate.
+	master, _ := raw["master"].(string)
+	if delegate, ok := raw["delegate"].(map[string]interface{}); ok && master == "" {
+		master, _ = delegate["master"].(string)
+	}
+	// The harness creates its own master for the run.
+	if master != "" && master != masterLink {
+		var err error
+		if _, lerr := netlink.LinkByName(master); lerr != nil {
+			err = fmt.Errorf("no such link")
+		}
+		checks = append(checks, check{name: "master " + master, err: err})
+	}
+	return checks
+}
+
+// dialEndpoint connects to the host and port of an URL.
+func dialEndpoint(endpoint string) error {
+	u, err := url.Parse(strings.TrimSpace(endpoint))
+	if err != nil {
+		return err
+	}
+	return dial("tcp", u.Host)
+}
+
+// dialSocket connects to a unix socket.
+func dialSocket(path string) error {
+	return dial("unix", path)
+}
+
+// dial connects to an address and returns why it could not without
+// repeating the address.
+func dial(network, address string) error {
+	c, err := net.DialTimeout(network, address, prerequisiteTimeout)
+	if err != nil {
+		if opErr, ok := err.(*net.OpError); ok {
+			return opErr.Err
+		}
+		return err
+	}
+	return c.Close()
+}
+
+// moduleAvailable checks a kernel module is loaded, built in or can be loaded
+// on demand. Without the module lists of the running kernel only loaded
+// modules can be told apart, so the rest pass.
+func moduleAvailable(name string) error {
+	if _, err := os.Stat(filepath.Join("/sys/module", name)); err == nil {
+		return nil
+	}
+
+	release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return nil
+	}
+	dir := filepath.Join("/lib/modules", strings.TrimSpace(string(release)))
+	if _, err := os.Stat(dir); err != nil {
+		return nil
+	}
+	for _, list := range []string{"modules.builtin", "modules.dep"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, list))
+		if err != nil {
+			continue
+		}
+		if strings.Contains(string(data), "/"+name+".ko") {
+			return nil
+		}
+	}
+	return fmt.Errorf("not in the kernel")
+}
+
+// checksum returns the sha256 of a file.
+func checksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// orDash returns s, or a dash if it is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
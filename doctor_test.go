@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExecutedTypes(t *testing.T) {
+	testCases := []struct {
+		conf     string
+		expected string
+	}{
+		{conf: `{"type": "bridge", "ipam": {"type": "host-local"}}`, expected: "bridge,host-local"},
+		{conf: `{"type": "portmap"}`, expected: "portmap"},
+		{conf: `{"type": "flannel", "delegate": {"bridge": "flannel0"}}`, expected: "flannel,bridge,host-local"},
+		{conf: `{"type": "flannel", "delegate": {"type": "ipvlan"}}`, expected: "flannel,ipvlan,host-local"},
+	}
+	for _, tc := range testCases {
+		raw := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(tc.conf), &raw); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(executedTypes(raw), ","); got != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.conf, tc.expected, got)
+		}
+	}
+}
+
+func TestInventoryProblems(t *testing.T) {
+	inv := &inventory{
+		binaries: []check{{name: "bridge"}, {name: "host-local", err: fmt.Errorf("not found")}},
+		modules:  []check{{name: "vxlan"}},
+		daemons:  []check{{name: "master eth0", err: fmt.Errorf("no such link")}},
+	}
+	expected := "host-local: not found; master eth0: no such link"
+	if got := strings.Join(inv.problems(), "; "); got != expected {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestSkipReasonMissingBinary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cni-benchmarks-doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := `{"cniVersion": "0.3.1", "name": "missing", "type": "no-such-plugin"}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "missing.conf"), []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &benchmarkCNI{pluginConfDir: dir, pluginDirs: []string{dir}}
+	reason, unmet := b.skipReason("missing")
+	if len(unmet) != 1 || !strings.HasPrefix(unmet[0], "no-such-plugin: not found") {
+		t.Fatalf("expected the binary to be missing, got %q", unmet)
+	}
+	if !strings.Contains(reason, unmet[0]) {
+		t.Fatalf("expected the reason to name the missing binary, got %q", reason)
+	}
+}
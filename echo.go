@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	// targetHost runs the echo server in the host network namespace.
+	targetHost = "host"
+	// targetExternal runs the echo server in a separate "external" network
+	// namespace that is only reachable by routing through the host.
+	targetExternal = "external"
+	// targetHTTPBin uses https://httpbin.org/ip and requires internet access.
+	targetHTTPBin = "httpbin"
+	httpBinHost   = "httpbin.org"
+
+	externalVethHost = "cnibench-ext0"
+	externalVethPeer = "cnibench-ext1"
+
+	ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+
+	echoTimeout = 5 * time.Second
+)
+
+var (
+	// The external namespace uses addresses from the benchmarking range
+	// (RFC 2544) so it does not collide with any of the plugin subnets.
+	externalHostAddr = &net.IPNet{IP: net.IPv4(198, 18, 0, 1), Mask: net.CIDRMask(30, 32)}
+	externalPeerAddr = &net.IPNet{IP: net.IPv4(198, 18, 0, 2), Mask: net.CIDRMask(30, 32)}
+
+	echoPayload = []byte("cni-benchmarks")
+)
+
+// echoServer is a local connectivity target. It answers HTTP requests for
+// /ip with the source address it saw, and echoes anything sent to its TCP
+// and UDP ports.
+type echoServer struct {
+	kind string
+	// ip is the address the pod should dial. If it is nil the address is
+	// discovered from inside the pod network namespace.
+	ip net.IP
+	// hostIP is the primary address of the host, used as a fallback when the
+	// pod has no gateway.
+	hostIP net.IP
+
+	httpListener net.Listener
+	tcpListener  net.Listener
+	udpConn      net.PacketConn
+
+	// externalNS is only set for the external target.
+	externalNS        netns.NsHandle
+	restoreIPForward  bool
+	originalIPForward string
+}
+
+// connectivityResult holds what the pod saw when talking to the target.
+type connectivityResult struct {
+	Family      string        `json:"family,omitempty"`
+	Target      string        `json:"target"`
+	SourceIP    string        `json:"sourceIP"`
+	HTTPLatency time.Duration `json:"httpLatency"`
+	TCPRTT      time.Duration `json:"tcpRTT"`
+	UDPRTT      time.Duration `json:"udpRTT"`
+}
+
+func (r connectivityResult) String() string {
+	s := fmt.Sprintf("target %s saw source IP %s (http %s", r.Target, r.SourceIP, r.HTTPLatency)
+	if r.Family != "" {
+		s = r.Family + " " + s
+	}
+	if r.TCPRTT > 0 {
+		s += fmt.Sprintf(", tcp rtt %s", r.TCPRTT)
+	}
+	if r.UDPRTT > 0 {
+		s += fmt.Sprintf(", udp rtt %s", r.UDPRTT)
+	}
+	return s + ")"
+}
+
+// newEchoServer starts the connectivity target of the given kind. The caller
+// must hold the OS thread lock and be in the host network namespace.
+func newEchoServer(kind string, originalNS netns.NsHandle) (*echoServer, error) {
+	s := &echoServer{kind: kind, externalNS: netns.None()}
+
+	switch kind {
+	case targetHTTPBin:
+		return s, nil
+	case targetHost:
+		ip, err := defaultRouteSource()
+		if err != nil {
+			return nil, err
+		}
+		s.hostIP = ip
+	case targetExternal:
+		if err := s.createExternalNS(originalNS); err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.ip = externalPeerAddr.IP
+	default:
+		return nil, fmt.Errorf("unknown connectivity target %q, must be one of %s, %s, %s", kind, targetHost, targetExternal, targetHTTPBin)
+	}
+
+	// Create the listeners, for the external target they have to be
+	// created from inside the external network namespace.
+	if s.externalNS.IsOpen() {
+		if err := netns.Set(s.externalNS); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("switching to external netns failed: %v", err)
+		}
+	}
+	err := s.listen()
+	if s.externalNS.IsOpen() {
+		if err := netns.Set(originalNS); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("returning to original namespace failed: %v", err)
+		}
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	go s.serveHTTP()
+	go s.serveTCP()
+	go s.serveUDP()
+
+	logrus.Debugf("Started %s connectivity target (http %s, tcp %s, udp %s)", kind, s.httpListener.Addr(), s.tcpListener.Addr(), s.udpConn.LocalAddr())
+	return s, nil
+}
+
+func (s *echoServer) listen() (err error) {
+	if s.httpListener, err = net.Listen("tcp", ":0"); err != nil {
+		return fmt.Errorf("creating http listener failed: %v", err)
+	}
+	if s.tcpListener, err = net.Listen("tcp", ":0"); err != nil {
+		return fmt.Errorf("creating tcp listener failed: %v", err)
+	}
+	if s.udpConn, err = net.ListenPacket("udp", ":0"); err != nil {
+		return fmt.Errorf("creating udp listener failed: %v", err)
+	}
+	return nil
+}
+
+func (s *echoServer) serveHTTP() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ip", func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"origin": host})
+	})
+	http.Serve(s.httpListener, mux)
+}
+
+func (s *echoServer) serveTCP() {
+	for {
+		conn, err := s.tcpListener.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			io.Copy(c, c)
+		}(conn)
+	}
+}
+
+func (s *echoServer) serveUDP() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := s.udpConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.udpConn.WriteTo(buf[:n], addr)
+	}
+}
+
+// Close stops the listeners and removes the external network namespace.
+func (s *echoServer) Close() {
+	if s.httpListener != nil {
+		s.httpListener.Close()
+	}
+	if s.tcpListener != nil {
+		s.tcpListener.Close()
+	}
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+	if s.externalNS.IsOpen() {
+		// Deleting the host side of the veth pair removes the peer as well.
+		if link, err := netlink.LinkByName(externalVethHost); err == nil {
+			netlink.LinkDel(link)
+		}
+		s.externalNS.Close()
+	}
+	if s.restoreIPForward {
+		ioutil.WriteFile(ipForwardPath, []byte(s.originalIPForward), 0644)
+	}
+}
+
+// createExternalNS creates a network namespace connected to the host with a
+// veth pair. Pods reach it through their default gateway.
+func (s *echoServer) createExternalNS(originalNS netns.NsHandle) error {
+	// Remove anything left over from a previous run.
+	if link, err := netlink.LinkByName(externalVethHost); err == nil {
+		netlink.LinkDel(link)
+	}
+
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: externalVethHost},
+		PeerName:  externalVethPeer,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("creating external veth pair failed: %v", err)
+	}
+	host, err := netlink.LinkByName(externalVethHost)
+	if err != nil {
+		return fmt.Errorf("getting external veth %s failed: %v", externalVethHost, err)
+	}
+	if err := netlink.AddrAdd(host, &netlink.Addr{IPNet: externalHostAddr}); err != nil {
+		return fmt.Errorf("adding address to %s failed: %v", externalVethHost, err)
+	}
+	if err := netlink.LinkSetUp(host); err != nil {
+		return fmt.Errorf("setting %s up failed: %v", externalVethHost, err)
+	}
+
+	// netns.New also switches the current thread into the new namespace.
+	s.externalNS, err = netns.New()
+	if err != nil {
+		return fmt.Errorf("creating external netns failed: %v", err)
+	}
+	if err := netns.Set(originalNS); err != nil {
+		return fmt.Errorf("returning to original namespace failed: %v", err)
+	}
+
+	peer, err := netlink.LinkByName(externalVethPeer)
+	if err != nil {
+		return fmt.Errorf("getting external veth %s failed: %v", externalVethPeer, err)
+	}
+	if err := netlink.LinkSetNsFd(peer, int(s.externalNS)); err != nil {
+		return fmt.Errorf("moving %s into external netns failed: %v", externalVethPeer, err)
+	}
+
+	// The forwarding sysctl is global, remember it so we can put it back.
+	forward, err := ioutil.ReadFile(ipForwardPath)
+	if err != nil {
+		return fmt.Errorf("reading %s failed: %v", ipForwardPath, err)
+	}
+	if strings.TrimSpace(string(forward)) != "1" {
+		if err := ioutil.WriteFile(ipForwardPath, []byte("1"), 0644); err != nil {
+			return fmt.Errorf("enabling ip forwarding failed: %v", err)
+		}
+		s.originalIPForward = string(forward)
+		s.restoreIPForward = true
+	}
+
+	if err := netns.Set(s.externalNS); err != nil {
+		return fmt.Errorf("switching to external netns failed: %v", err)
+	}
+	defer netns.Set(originalNS)
+
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("getting loopback in external netns failed: %v", err)
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("setting loopback up in external netns failed: %v", err)
+	}
+	peer, err = netlink.LinkByName(externalVethPeer)
+	if err != nil {
+		return fmt.Errorf("getting %s in external netns failed: %v", externalVethPeer, err)
+	}
+	if err := netlink.AddrAdd(peer, &netlink.Addr{IPNet: externalPeerAddr}); err != nil {
+		return fmt.Errorf("adding address to %s failed: %v", externalVethPeer, err)
+	}
+	if err := netlink.LinkSetUp(peer); err != nil {
+		return fmt.Errorf("setting %s up failed: %v", externalVethPeer, err)
+	}
+	if err := netlink.RouteAdd(&netlink.Route{Gw: externalHostAddr.IP}); err != nil {
+		return fmt.Errorf("adding default route in external netns failed: %v", err)
+	}
+
+	return nil
+}
+
+// serves reports whether the target can be reached over an address family.
+// The external target only has an IPv4 address.
+func (s *echoServer) serves(family string) bool {
+	return s.ip == nil || ipFamily(s.ip) == family
+}
+
+// address returns the address the pod should use to reach the target over
+// an address family. It must be called from inside the pod network
+// namespace.
+func (s *echoServer) address(gateway net.IP, family string) (net.IP, error) {
+	if s.ip != nil {
+		if ipFamily(s.ip) != family {
+			return nil, fmt.Errorf("the %s target has no %s address", s.kind, family)
+		}
+		return s.ip, nil
+	}
+
+	// Prefer the gateway the plugin handed out, for bridge and ptp this is
+	// an address on the host.
+	if gateway != nil {
+		return gateway, nil
+	}
+	routes, err := netlink.RouteList(nil, netlinkFamily(family))
+	if err != nil {
+		return nil, fmt.Errorf("listing routes in netns failed: %v", err)
+	}
+	for _, r := range routes {
+		if r.Dst == nil && r.Gw != nil {
+			return r.Gw, nil
+		}
+	}
+
+	if s.hostIP != nil && ipFamily(s.hostIP) == family {
+		return s.hostIP, nil
+	}
+	return nil, fmt.Errorf("could not discover an %s address for the %s target", family, s.kind)
+}
+
+// check runs the connectivity check against the target over an address
+// family. It must be called from inside the pod network namespace with the
+// OS thread locked, the sockets are created synchronously so they belong to
+// the pod namespace.
+func (s *echoServer) check(gateway net.IP, family string) (*connectivityResult, error) {
+	if s.kind == targetHTTPBin {
+		return checkHTTPBin()
+	}
+
+	ip, err := s.address(gateway, family)
+	if err != nil {
+		return nil, err
+	}
+	r := &connectivityResult{Family: family, Target: ip.String()}
+
+	port := s.httpListener.Addr().(*net.TCPAddr).Port
+	origin, latency, err := httpOrigin(net.JoinHostPort(ip.String(), fmt.Sprintf("%d", port)))
+	if err != nil {
+		return nil, err
+	}
+	r.SourceIP = origin
+	r.HTTPLatency = latency
+
+	port = s.tcpListener.Addr().(*net.TCPAddr).Port
+	if r.TCPRTT, err = echoRTT("tcp", net.JoinHostPort(ip.String(), fmt.Sprintf("%d", port))); err != nil {
+		return nil, err
+	}
+
+	port = s.udpConn.LocalAddr().(*net.UDPAddr).Port
+	if r.UDPRTT, err = echoRTT("udp", net.JoinHostPort(ip.String(), fmt.Sprintf("%d", port))); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// httpOrigin asks the echo server which source address it saw. We dial the
+// connection ourselves since the http.Transport dials from a different
+// goroutine, which might not be in the pod network namespace.
+func httpOrigin(addr string) (string, time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, echoTimeout)
+	if err != nil {
+		return "", 0, fmt.Errorf("dialing http target %s failed: %v", addr, err)
+	}
+	defer conn.Close()
+
+	origin, err := requestOrigin(conn, "http://"+addr+"/ip")
+	if err != nil {
+		return "", 0, err
+	}
+	return origin, time.Since(start), nil
+}
+
+// requestOrigin gets url over conn and returns the origin in the response,
+// the way httpbin answers /ip.
+func requestOrigin(conn net.Conn, url string) (string, error) {
+	conn.SetDeadline(time.Now().Add(echoTimeout))
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return "", fmt.Errorf("writing http request to %s failed: %v", req.URL.Host, err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return "", fmt.Errorf("reading http response from %s failed: %v", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Origin string `json:"origin"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decoding http response from %s failed: %v", req.URL.Host, err)
+	}
+	return body.Origin, nil
+}
+
+// echoRTT sends a payload to the echo server and times the round trip.
+func echoRTT(network, addr string) (time.Duration, error) {
+	conn, err := net.DialTimeout(network, addr, echoTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("dialing %s target %s failed: %v", network, addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(echoTimeout))
+
+	buf := make([]byte, len(echoPayload))
+	start := time.Now()
+	if _, err := conn.Write(echoPayload); err != nil {
+		return 0, fmt.Errorf("writing to %s target %s failed: %v", network, addr, err)
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return 0, fmt.Errorf("reading from %s target %s failed: %v", network, addr, err)
+	}
+	return time.Since(start), nil
+}
+
+// checkHTTPBin gets an outbound resource from httpbin.org. Like httpOrigin
+// it dials and does the TLS handshake on this thread, so the connection
+// leaves from the pod network namespace. The name is resolved first, the
+// resolver may do it on another thread.
+func checkHTTPBin() (*connectivityResult, error) {
+	start := time.Now()
+	ips, err := net.LookupIP(httpBinHost)
+	if err != nil || len(ips) == 0 {
+		return nil, fmt.Errorf("resolving %s failed: %v", httpBinHost, err)
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ips[0].String(), "443"), echoTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("getting an out of network resource failed: %v", err)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: httpBinHost})
+	defer tlsConn.Close()
+
+	origin, err := requestOrigin(tlsConn, "https://"+httpBinHost+"/ip")
+	if err != nil {
+		return nil, fmt.Errorf("getting an out of network resource failed: %v", err)
+	}
+
+	return &connectivityResult{
+		Target:      httpBinHost,
+		SourceIP:    origin,
+		HTTPLatency: time.Since(start),
+	}, nil
+}
+
+// defaultRouteSource returns the source address of the host's default
+// route.
+func defaultRouteSource() (net.IP, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("listing host routes failed: %v", err)
+	}
+	for _, r := range routes {
+		if r.Dst != nil {
+			continue
+		}
+		if r.Src != nil {
+			return r.Src, nil
+		}
+		link, err := netlink.LinkByIndex(r.LinkIndex)
+		if err != nil {
+			continue
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+		return addrs[0].IP, nil
+	}
+	// Not having a default route is fine, pods might still have a gateway.
+	return nil, nil
+}
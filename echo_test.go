@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestOrigin(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		fmt.Fprintf(w, `{"origin": %q}`, host)
+	}))
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	defer tlsConn.Close()
+
+	origin, err := requestOrigin(tlsConn, s.URL+"/ip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if origin != "127.0.0.1" {
+		t.Fatalf("expected origin 127.0.0.1, got %q", origin)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	cni "github.com/containerd/go-cni"
+	"github.com/vishvananda/netlink"
+)
+
+// Address families, in the order they are checked.
+const (
+	familyV4 = "ipv4"
+	familyV6 = "ipv6"
+)
+
+var families = []string{familyV4, familyV6}
+
+// ipFamily returns the address family of ip.
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return familyV4
+	}
+	return familyV6
+}
+
+// netlinkFamily returns the netlink constant for an address family.
+func netlinkFamily(family string) int {
+	if family == familyV6 {
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_V4
+}
+
+// defaultIPConfigs returns the first IP configuration of every address
+// family on the default interface, IPv4 first.
+func defaultIPConfigs(result *cni.CNIResult) ([]*cni.IPConfig, error) {
+	defaultInterface := cni.DefaultPrefix + "0"
+	iface, ok := result.Interfaces[defaultInterface]
+	if !ok || len(iface.IPConfigs) == 0 {
+		return nil, fmt.Errorf("result has no IP for the default interface (%s)", defaultInterface)
+	}
+
+	configs := []*cni.IPConfig{}
+	for _, family := range families {
+		for _, c := range iface.IPConfigs {
+			if ipFamily(c.IP) == family {
+				configs = append(configs, c)
+				break
+			}
+		}
+	}
+	return configs, nil
+}
+
+// primaryIPConfig returns the IPv4 configuration of the default interface,
+// or the IPv6 one on IPv6-only networks.
+func primaryIPConfig(result *cni.CNIResult) (*cni.IPConfig, error) {
+	configs, err := defaultIPConfigs(result)
+	if err != nil {
+		return nil, err
+	}
+	return configs[0], nil
+}
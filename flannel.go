@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// flannelMTU is the MTU flanneld hands out with the vxlan backend.
+const flannelMTU = 1450
+
+// standInFlannel writes a subnet file like the one flanneld writes, and
+// points the flannel configurations at it, so flannel and the plugins it
+// delegates to run without the daemon.
+func (b *benchmarkCNI) standInFlannel(plugins []string, subnet string) error {
+	env, err := flannelSubnetEnv(subnet)
+	if err != nil {
+		return err
+	}
+
+	dir, err := b.renderDirectory()
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(dir, "subnet.env")
+	if err := ioutil.WriteFile(file, []byte(env), 0644); err != nil {
+		return fmt.Errorf("writing flannel subnet file failed: %v", err)
+	}
+
+	for _, plugin := range plugins {
+		types, err := b.pluginTypes(plugin)
+		if err != nil {
+			return err
+		}
+		if !contains(types, "flannel") {
+			continue
+		}
+		if err := b.render(plugin, func(conf map[string]interface{}) error {
+			for _, c := range pluginConfs(conf) {
+				if c["type"] == "flannel" {
+					c["subnetFile"] = file
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{"plugin": plugin}).Infof("using the flannel subnet file %s for %s", file, subnet)
+	}
+	return nil
+}
+
+// flannelSubnetEnv returns the contents of a flannel subnet file for the
+// subnet of this host, in a /16 network like flanneld hands them out from.
+func flannelSubnetEnv(subnet string) (string, error) {
+	ip, sn, err := net.ParseCIDR(subnet)
+	if err != nil || ip.To4() == nil {
+		return "", fmt.Errorf("flannel subnet %q must be an IPv4 CIDR", subnet)
+	}
+	network := &net.IPNet{IP: sn.IP.Mask(net.CIDRMask(16, 32)), Mask: net.CIDRMask(16, 32)}
+	if ones, _ := sn.Mask.Size(); ones < 16 {
+		network = sn
+	}
+	// The address is the gateway on the host, flanneld uses the first one.
+	if ip.Equal(sn.IP) {
+		ip = nextIP(sn.IP)
+	}
+	return fmt.Sprintf("FLANNEL_NETWORK=%s\nFLANNEL_SUBNET=%s\nFLANNEL_MTU=%d\nFLANNEL_IPMASQ=false\n",
+		network, &net.IPNet{IP: ip, Mask: sn.Mask}, flannelMTU), nil
+}
+
+// readFlannelSubnet returns the subnet of this host in a flannel subnet file. The
+// flannel plugin hands out its addresses, the first one is the gateway.
+func readFlannelSubnet(file string) (*net.IPNet, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading flannel subnet file failed: %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "FLANNEL_SUBNET=") {
+			continue
+		}
+		_, sn, err := net.ParseCIDR(strings.TrimSpace(strings.TrimPrefix(line, "FLANNEL_SUBNET=")))
+		if err != nil {
+			return nil, fmt.Errorf("parsing FLANNEL_SUBNET of %s failed: %v", file, err)
+		}
+		return sn, nil
+	}
+	return nil, fmt.Errorf("%s has no FLANNEL_SUBNET", file)
+}
+
+// nextIP returns the address after ip.
+func nextIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
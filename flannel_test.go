@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestFlannelSubnetEnv(t *testing.T) {
+	testCases := []struct {
+		subnet   string
+		expected string
+	}{
+		{
+			subnet:   "10.244.1.0/24",
+			expected: "FLANNEL_NETWORK=10.244.0.0/16\nFLANNEL_SUBNET=10.244.1.1/24\nFLANNEL_MTU=1450\nFLANNEL_IPMASQ=false\n",
+		},
+		{
+			subnet:   "10.244.1.1/24",
+			expected: "FLANNEL_NETWORK=10.244.0.0/16\nFLANNEL_SUBNET=10.244.1.1/24\nFLANNEL_MTU=1450\nFLANNEL_IPMASQ=false\n",
+		},
+		{
+			subnet:   "10.0.0.0/8",
+			expected: "FLANNEL_NETWORK=10.0.0.0/8\nFLANNEL_SUBNET=10.0.0.1/8\nFLANNEL_MTU=1450\nFLANNEL_IPMASQ=false\n",
+		},
+	}
+	for _, tc := range testCases {
+		got, err := flannelSubnetEnv(tc.subnet)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.subnet, err)
+		}
+		if got != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.subnet, tc.expected, got)
+		}
+	}
+
+	if _, err := flannelSubnetEnv("fd00::/64"); err == nil {
+		t.Fatal("expected an IPv6 subnet to be refused")
+	}
+}
+
+func TestNextIP(t *testing.T) {
+	testCases := []struct {
+		ip       string
+		expected string
+	}{
+		{ip: "10.1.2.0", expected: "10.1.2.1"},
+		{ip: "10.1.2.255", expected: "10.1.3.0"},
+		{ip: "fd00:20:0:1::", expected: "fd00:20:0:1::1"},
+		{ip: "fd00::ffff", expected: "fd00::1:0"},
+	}
+	for _, tc := range testCases {
+		if got := nextIP(net.ParseIP(tc.ip)).String(); got != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.ip, tc.expected, got)
+		}
+	}
+}
+
+func TestReadFlannelSubnet(t *testing.T) {
+	env, err := flannelSubnetEnv("10.244.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "subnet.env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(env); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	sn, err := readFlannelSubnet(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "10.244.1.0/24"; sn.String() != expected {
+		t.Fatalf("expected %s, got %s", expected, sn)
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte("FLANNEL_NETWORK=10.244.0.0/16\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readFlannelSubnet(f.Name()); err == nil {
+		t.Fatal("expected an error without FLANNEL_SUBNET")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// defaultIPAMDataDir is where host-local keeps its reservations when the
+// configuration does not set a dataDir.
+const defaultIPAMDataDir = "/var/lib/cni/networks"
+
+// hostSnapshot is the networking state of the host namespace that plugins
+// are expected to clean up after a DEL. Every object is a string so two
+// snapshots can be compared as sets.
+type hostSnapshot map[string]bool
+
+// snapshotHost records the links, addresses, routes, static neighbors,
+// files under the IPAM data directories and NAT rules of the current
+// network namespace.
+func snapshotHost(ipamDirs []string) (hostSnapshot, error) {
+	s := hostSnapshot{}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("listing links failed: %v", err)
+	}
+	names := map[int]string{}
+	for _, link := range links {
+		attrs := link.Attrs()
+		names[attrs.Index] = attrs.Name
+		s[fmt.Sprintf("link %s (%s)", attrs.Name, link.Type())] = true
+
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("listing addresses of %s failed: %v", attrs.Name, err)
+		}
+		for _, addr := range addrs {
+			s[fmt.Sprintf("address %s dev %s", addr.IPNet, attrs.Name)] = true
+		}
+	}
+
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("listing routes failed: %v", err)
+	}
+	for _, route := range routes {
+		// The local table follows the addresses.
+		if route.Table == unix.RT_TABLE_LOCAL {
+			continue
+		}
+		s["route "+formatRoute(route, names)] = true
+	}
+
+	neighbors, err := netlink.NeighList(0, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("listing neighbors failed: %v", err)
+	}
+	for _, n := range neighbors {
+		// Learned entries come and go with traffic, only the ones someone
+		// installed count.
+		if n.State&(netlink.NUD_PERMANENT|netlink.NUD_NOARP) == 0 || n.IP == nil {
+			continue
+		}
+		s[fmt.Sprintf("neighbor %s lladdr %s dev %s", n.IP, n.HardwareAddr, names[n.LinkIndex])] = true
+	}
+
+	for _, dir := range ipamDirs {
+		if err := snapshotIPAM(s, dir); err != nil {
+			return nil, err
+		}
+	}
+
+	rules, err := natRules()
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		s["nat "+rule] = true
+	}
+
+	return s, nil
+}
+
+func formatRoute(r netlink.Route, names map[int]string) string {
+	dst := "default"
+	if r.Dst != nil {
+		dst = r.Dst.String()
+	}
+	parts := []string{dst}
+	if r.Gw != nil {
+		parts = append(parts, "via "+r.Gw.String())
+	}
+	if name, ok := names[r.LinkIndex]; ok {
+		parts = append(parts, "dev "+name)
+	} else if r.LinkIndex > 0 {
+		parts = append(parts, fmt.Sprintf("dev %d", r.LinkIndex))
+	}
+	if r.Src != nil {
+		parts = append(parts, "src "+r.Src.String())
+	}
+	if r.Table != unix.RT_TABLE_MAIN {
+		parts = append(parts, fmt.Sprintf("table %d", r.Table))
+	}
+	return strings.Join(parts, " ")
+}
+
+// snapshotIPAM adds the files under an IPAM data directory. The lock and the
+// last reserved IP are bookkeeping host-local keeps across containers, the
+// reservations are what leaks.
+func snapshotIPAM(s hostSnapshot, dir string) error {
+	err := filepath.Walk(dir, func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() || f.Name() == "lock" || strings.HasPrefix(f.Name(), "last_reserved_ip") {
+			return nil
+		}
+		s["ipam "+p] = true
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("walking IPAM data directory %s failed: %v", dir, err)
+	}
+	return nil
+}
+
+// natRules returns the rules of the nat table without their counters, or
+// nothing when iptables is not installed.
+func natRules() ([]string, error) {
+	path, err := exec.LookPath("iptables-save")
+	if err != nil {
+		return nil, nil
+	}
+	out, err := exec.Command(path, "-t", "nat").Output()
+	if err != nil {
+		return nil, fmt.Errorf("running iptables-save failed: %v", err)
+	}
+
+	rules := []string{}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, "-A "):
+			rules = append(rules, line)
+		case strings.HasPrefix(line, ":"):
+			// Chains look like ":CNI-1234 - [0:0]".
+			rules = append(rules, "chain "+strings.Fields(line)[0][1:])
+		}
+	}
+	return rules, s.Err()
+}
+
+// leaks returns the objects in after that are not in before, sorted. State
+// plugins keep across pods by design is not a leak, even when the first ADD
+// created it.
+func (before hostSnapshot) leaks(after hostSnapshot) []string {
+	// A bridge is shared by all the pods on it, with its addresses and
+	// routes.
+	bridges := map[string]bool{}
+	for o := range after {
+		if !before[o] && strings.HasPrefix(o, "link ") && strings.HasSuffix(o, " (bridge)") {
+			bridges[strings.Fields(o)[1]] = true
+		}
+	}
+
+	leaked := []string{}
+	for o := range after {
+		if !before[o] && !sharedState(o, bridges) {
+			leaked = append(leaked, o)
+		}
+	}
+	sort.Strings(leaked)
+	return leaked
+}
+
+// sharedState reports whether an object is kept across pods by design: the
+// bridges created between the snapshots and what is on them, the IPv6
+// link-local and multicast addresses and routes the kernel adds to new
+// links, and the chains portmap shares between all the pods.
+func sharedState(o string, bridges map[string]bool) bool {
+	fields := strings.Fields(o)
+	if len(fields) < 2 {
+		return false
+	}
+	switch fields[0] {
+	case "link":
+		return bridges[fields[1]]
+	case "address", "route", "neighbor":
+		for i := 2; i < len(fields)-1; i++ {
+			if fields[i] == "dev" && bridges[fields[i+1]] {
+				return true
+			}
+		}
+		if _, sn, err := net.ParseCIDR(fields[1]); err == nil && sn.IP.To4() == nil {
+			return sn.IP.IsLinkLocalUnicast() || sn.IP.IsMulticast()
+		}
+	case "nat":
+		return strings.Contains(o, "CNI-HOSTPORT-")
+	}
+	return false
+}
+
+// printLeaks writes the objects every plugin left behind and in how many
+// iterations.
+func printLeaks(w io.Writer, stats []*pluginStats) error {
+	tw := tabwriter.NewWriter(w, 10, 1, 3, ' ', 0)
+	fmt.Fprintln(tw, "PLUGIN\tLEAKY ITERATIONS\tCOUNT\tLEFTOVER")
+	for _, ps := range stats {
+		if len(ps.leaks) == 0 {
+			fmt.Fprintf(tw, "%s\t0\t\t\n", ps.plugin)
+			continue
+		}
+		objects := []string{}
+		for o := range ps.leaks {
+			objects = append(objects, o)
+		}
+		sort.Strings(objects)
+		for i, o := range objects {
+			if i == 0 {
+				fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", ps.plugin, ps.leakyIterations, ps.leaks[o], o)
+				continue
+			}
+			fmt.Fprintf(tw, "\t\t%d\t%s\n", ps.leaks[o], o)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLeaks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cni-benchmarks-ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	before := hostSnapshot{"link cni0 (bridge)": true}
+	if err := snapshotIPAM(before, filepath.Join(dir, "missing")); err != nil {
+		t.Fatalf("a missing IPAM directory should be fine: %v", err)
+	}
+
+	for _, name := range []string{"lock", "last_reserved_ip.0", "10.10.0.2"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("1234"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after := hostSnapshot{"link cni0 (bridge)": true, "link veth1234 (veth)": true}
+	if err := snapshotIPAM(after, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"ipam " + filepath.Join(dir, "10.10.0.2"), "link veth1234 (veth)"}
+	if leaked := before.leaks(after); !reflect.DeepEqual(leaked, expected) {
+		t.Fatalf("expected leaks %v, got %v", expected, leaked)
+	}
+	if leaked := after.leaks(before); len(leaked) != 0 {
+		t.Fatalf("objects that went away are not leaks, got %v", leaked)
+	}
+}
+
+func TestLeaksFirstUseBridge(t *testing.T) {
+	before := hostSnapshot{
+		"link eth0 (device)":                        true,
+		"route 192.0.2.0/24 dev eth0 src 192.0.2.2": true,
+	}
+	// What the first ADD and DEL of bridge-portmap leave on a fresh host,
+	// plus a veth the DEL forgot.
+	after := hostSnapshot{
+		"link eth0 (device)":                                                  true,
+		"route 192.0.2.0/24 dev eth0 src 192.0.2.2":                           true,
+		"link cni1 (bridge)":                                                  true,
+		"address 10.11.0.1/16 dev cni1":                                       true,
+		"address fe80::1c2a:ff:fe00:1/64 dev cni1":                            true,
+		"route 10.11.0.0/16 dev cni1 src 10.11.0.1":                           true,
+		"route fe80::/64 dev cni1":                                            true,
+		"route ff00::/8 dev eth0 table 255":                                   true,
+		"nat chain CNI-HOSTPORT-DNAT":                                         true,
+		"nat -A PREROUTING -m addrtype --dst-type LOCAL -j CNI-HOSTPORT-DNAT": true,
+		"link veth1234 (veth)":                                                true,
+		"address fe80::1/64 dev veth1234":                                     true,
+		"nat chain CNI-DN-1234":                                               true,
+	}
+	expected := []string{"link veth1234 (veth)", "nat chain CNI-DN-1234"}
+	if leaked := before.leaks(after); !reflect.DeepEqual(leaked, expected) {
+		t.Fatalf("expected leaks %v, got %v", expected, leaked)
+	}
+}
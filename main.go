@@ -1,16 +1,15 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
-	"syscall"
+	"time"
 
 	cni "github.com/containerd/go-cni"
 	"github.com/jessfraz/cni-benchmarks/version"
@@ -29,20 +28,98 @@ const (
 )
 
 var (
+	target     string
+	output     string
+	outputFile string
+
+	iterations    int
+	warmup        int
+	converge      float64
+	maxIterations int
+
+	concurrency string
+	scaleSteps  string
+	portCounts  string
+	rates       string
+	cniVersions bool
+
+	flannelSubnet string
+	setValues     = templateValues{}
+
+	trace  bool
+	rusage bool
+
+	netnsProvider string
+
+	rootless bool
+
+	checkLeaks bool
+	strict     bool
+
+	dataPlane    time.Duration
+	readyTimeout time.Duration
+
 	debug bool
 	vrsn  bool
 )
 
 func init() {
+	flag.StringVar(&target, "target", targetHost, "connectivity check target: host, external (separate netns routed through the host), or httpbin (needs internet)")
+
+	flag.StringVar(&output, "output", "", "write a machine-readable report of every run: json or csv")
+	flag.StringVar(&outputFile, "output-file", "", "file to write the report to (default is stdout)")
+
+	flag.IntVar(&iterations, "iterations", 1, "number of iterations to run per plugin (the minimum when converging)")
+	flag.IntVar(&warmup, "warmup", 0, "number of warmup iterations to run per plugin before measuring")
+	flag.Float64Var(&converge, "converge", 0, "keep sampling until the 95% confidence interval of the ADD and DEL mean is within this fraction of the mean (e.g. 0.05), 0 disables")
+	flag.IntVar(&maxIterations, "max-iterations", 1000, "upper bound on the number of iterations when converging")
+
+	flag.StringVar(&concurrency, "concurrency", "", "run the pod churn benchmark with this many concurrent workers, a comma separated list sweeps them (e.g. 1,2,4,8,16)")
+
+	flag.StringVar(&scaleSteps, "scale", "", "run the scale benchmark, keeping this many pods attached while measuring the next one, as a comma separated list (e.g. 0,10,50,250)")
+
+	flag.StringVar(&portCounts, "portmap", "", "run the port mapping benchmark on the configurations chaining portmap, mapping this many ports as a comma separated list (e.g. 0,1,10,100)")
+
+	flag.StringVar(&rates, "bandwidth", "", "run the traffic shaping benchmark on the configurations chaining bandwidth, limiting ingress and egress to these rates in Mbit/s as a comma separated list, 0 is unshaped (e.g. 0,10,100)")
+
+	flag.BoolVar(&cniVersions, "cni-versions", false, "run every configuration at each cniVersion all the plugins in it support, as reported by VERSION")
+
+	flag.StringVar(&flannelSubnet, "flannel-subnet", "", "write a stand-in for the subnet file of flanneld with this subnet (e.g. 10.244.1.1/24) and point the flannel configurations at it, so they run without the daemon")
+
+	flag.Var(setValues, "set", "set a value for the configuration templates as key=value, can be repeated, master defaults to the cnibench-m0 link the program creates and mtu to the one of the default route or of the master (e.g. master=ens3)")
+
+	flag.BoolVar(&trace, "trace", false, "trace every plugin binary executed during ADD and DEL, including delegated plugins, and print a timeline (default benchmark only)")
+	flag.BoolVar(&rusage, "rusage", false, "record the CPU time, max RSS, context switches and page faults of the plugins run for ADD and DEL, the plugins run through shims which add to the latency (default benchmark only)")
+
+	flag.StringVar(&netnsProvider, "netns", nsProcess, "how to create the pod network namespaces: process (held by a process that unshared it), named (bind-mounted under /var/run/netns), or pause (held by a process with its own network, IPC, UTS, PID and mount namespaces)")
+
+	flag.BoolVar(&rootless, "rootless", false, "run without root in a user namespace with a private host network namespace, plugins that need real root are skipped")
+
+	flag.DurationVar(&readyTimeout, "ready", 0, "after ADD returns, probe on a tight loop until the gateway is resolved and a TCP connection to the target gets through, giving up after this long (e.g. 10s), 0 disables")
+	flag.DurationVar(&dataPlane, "dataplane", 0, "after ADD, attach a second pod and measure TCP throughput, UDP packet rate, request/response latency and connections per second to it and to the host, for this long each (e.g. 1s), 0 disables")
+
+	flag.BoolVar(&checkLeaks, "leaks", false, "compare the host links, addresses, routes, static neighbors, IPAM files and NAT rules before ADD and after DEL, and report leftovers")
+	flag.BoolVar(&strict, "strict", false, "fail an iteration that leaves anything behind (implies -leaks)")
+
 	flag.BoolVar(&vrsn, "version", false, "print version and exit")
 	flag.BoolVar(&vrsn, "v", false, "print version and exit (shorthand)")
 	flag.BoolVar(&debug, "d", false, "run in debug mode")
 
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr, fmt.Sprintf(BANNER, version.VERSION))
+		fmt.Fprint(os.Stderr, "Usage: cni-benchmarks [flags] [command]\n\nCommands:\n  compare\tcompare two result files and detect regressions\n  conformance\tcheck every plugin against edge cases of the CNI spec\n  doctor\tlist the configurations, their binaries and prerequisites (alias list)\n\nFlags:\n")
 		flag.PrintDefaults()
 	}
+}
+
+func main() {
+	// We are standing in for a plugin binary to trace its execution.
+	if isShim() {
+		os.Exit(runShim())
+	}
 
+	// Parse the flags here rather than in init so the go test flags do not
+	// get rejected when running the benchmarks.
 	flag.Parse()
 
 	if vrsn {
@@ -54,9 +131,48 @@ func init() {
 	if debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
-}
 
-func main() {
+	if strict {
+		checkLeaks = true
+	}
+
+	// The timeline and the resource usage are printed by the default
+	// benchmark only, the other modes would just pay for the shims.
+	if flag.Arg(0) == "conformance" || concurrency != "" || scaleSteps != "" || portCounts != "" || rates != "" || cniVersions {
+		if trace || rusage {
+			logrus.Fatal("-trace and -rusage cannot be combined with conformance, -concurrency, -scale, -portmap, -bandwidth or -cni-versions")
+		}
+	}
+
+	// Subcommands that do not need to create any namespaces.
+	if flag.Arg(0) == "compare" {
+		if err := runCompare(flag.Args()[1:], os.Stdout); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "list" || flag.Arg(0) == "doctor" {
+		b, err := newCNIBenchmark(false)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer b.originalNS.Close()
+		defer b.removeRendered()
+		if err := b.runDoctor(os.Stdout); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+
+	if rootless {
+		if !inRootlessNS() {
+			os.Exit(reexecRootless())
+		}
+		if err := setupRootless(); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
 	// Lock the OS Thread so we don't accidentally switch namespaces.
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
@@ -66,47 +182,237 @@ func main() {
 		logrus.Fatal(err)
 	}
 	defer b.originalNS.Close()
+	defer b.removeRendered()
 
-	// Walk the configuration directory and get all the configs.
-	plugins := []string{}
-	if err := filepath.Walk(b.pluginConfDir, func(p string, f os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	b.namespaces, err = newNSProvider(netnsProvider, b.binDir)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	// Start the target for the connectivity checks.
+	b.target, err = newEchoServer(target, b.originalNS)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer b.target.Close()
 
-		if f.IsDir() {
-			// Skip directories.
-			return nil
+	// The resource usage is collected by the trace shims.
+	if trace || rusage {
+		if err := b.enableTracing(); err != nil {
+			logrus.Fatal(err)
 		}
+		defer b.tracer.Close()
+	}
 
-		plugins = append(plugins, filepath.Base(strings.TrimSuffix(p, ".conf")))
-		return nil
-	}); err != nil {
-		logrus.Fatalf("walking plugin configuration directory %s failed: %v", b.pluginConfDir, err)
+	plugins, err := b.plugins()
+	if err != nil {
+		logrus.Fatal(err)
 	}
 	logrus.Infof("Found plugin configurations for %s", strings.Join(plugins, ", "))
 
+	if err := b.renderTemplates(plugins); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := b.rootlessDataDirs(plugins); err != nil {
+		logrus.Fatal(err)
+	}
+	// The master needs the flannel subnet file for the gateway of the
+	// delegate.
+	if flannelSubnet != "" {
+		if err := b.standInFlannel(plugins, flannelSubnet); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	master, err := b.setupMaster(plugins)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer master.Close()
+
 	logrus.Infof("Parent process ($this) has PID %d", os.Getpid())
 
-	// Iterate over the plugin configurations.
+	// Setup the machine-readable report.
+	var report reportWriter
+	if output != "" {
+		w := os.Stdout
+		if outputFile != "" {
+			f, err := os.Create(outputFile)
+			if err != nil {
+				logrus.Fatalf("creating output file %s failed: %v", outputFile, err)
+			}
+			defer f.Close()
+			w = f
+		}
+		report, err = newReportWriter(output, w)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	// Tables go to stdout, unless the report is going there.
+	tableOut := os.Stdout
+	if report != nil && outputFile == "" {
+		tableOut = os.Stderr
+	}
+	write := func(r *record) {
+		if report == nil {
+			return
+		}
+		if err := report.Write(r); err != nil {
+			logrus.Fatalf("writing report failed: %v", err)
+		}
+	}
+
+	// Skip the plugins that cannot run here.
+	runnable, skipped := []string{}, []*pluginStats{}
+	for _, plugin := range plugins {
+		reason, unmet := b.skipReason(plugin)
+		if reason == "" {
+			runnable = append(runnable, plugin)
+			continue
+		}
+		logrus.WithFields(logrus.Fields{"plugin": plugin}).Warnf("skipping: %s", reason)
+		write(&record{Plugin: plugin, Skipped: reason, Unmet: unmet})
+		ps := newPluginStats(plugin)
+		ps.skipped = reason
+		skipped = append(skipped, ps)
+	}
+	plugins = runnable
+
+	// Failing conformance cases are reported once the report is written.
+	var conformanceErr error
+	switch {
+	case flag.Arg(0) == "conformance":
+		conformanceErr = b.runConformance(plugins, write, tableOut)
+	case concurrency != "":
+		sweep, err := parseIntList(concurrency)
+		if err != nil {
+			logrus.Fatalf("parsing concurrency failed: %v", err)
+		}
+		if err := b.runChurn(plugins, sweep, write, tableOut); err != nil {
+			logrus.Fatal(err)
+		}
+	case scaleSteps != "":
+		ks, err := parseIntList(scaleSteps)
+		if err != nil {
+			logrus.Fatalf("parsing scale failed: %v", err)
+		}
+		if err := b.runScale(plugins, ks, write, tableOut); err != nil {
+			logrus.Fatal(err)
+		}
+	case portCounts != "":
+		counts, err := parseIntList(portCounts)
+		if err != nil {
+			logrus.Fatalf("parsing portmap failed: %v", err)
+		}
+		if err := b.runPortMap(plugins, counts, write, tableOut); err != nil {
+			logrus.Fatal(err)
+		}
+	case rates != "":
+		mbits, err := parseIntList(rates)
+		if err != nil {
+			logrus.Fatalf("parsing bandwidth failed: %v", err)
+		}
+		if err := b.runBandwidth(plugins, mbits, write, tableOut); err != nil {
+			logrus.Fatal(err)
+		}
+	case cniVersions:
+		if err := b.runVersions(plugins, write, tableOut); err != nil {
+			logrus.Fatal(err)
+		}
+	default:
+		stats := b.runIterations(plugins, sampler{
+			iterations:    iterations,
+			converge:      converge,
+			maxIterations: maxIterations,
+		}, write, tableOut)
+		if err := printStats(tableOut, append(stats, skipped...)); err != nil {
+			logrus.Fatalf("printing statistics failed: %v", err)
+		}
+		if rusage {
+			fmt.Fprintln(tableOut)
+			if err := printUsage(tableOut, stats); err != nil {
+				logrus.Fatalf("printing resource usage failed: %v", err)
+			}
+		}
+		if checkLeaks {
+			fmt.Fprintln(tableOut)
+			if err := printLeaks(tableOut, stats); err != nil {
+				logrus.Fatalf("printing leaks failed: %v", err)
+			}
+		}
+		if dataPlane > 0 {
+			fmt.Fprintln(tableOut)
+			if err := printDataPlane(tableOut, stats); err != nil {
+				logrus.Fatalf("printing data plane results failed: %v", err)
+			}
+		}
+	}
+
+	if report != nil {
+		if err := report.Flush(); err != nil {
+			logrus.Fatalf("writing report failed: %v", err)
+		}
+	}
+	if conformanceErr != nil {
+		logrus.Fatal(conformanceErr)
+	}
+}
+
+// runIterations runs every plugin as many times as the sampler wants and
+// returns the ADD and DEL statistics.
+func (b *benchmarkCNI) runIterations(plugins []string, s sampler, write func(*record), w io.Writer) []*pluginStats {
+	stats := []*pluginStats{}
 	for _, plugin := range plugins {
 		logrus.WithFields(logrus.Fields{"plugin": plugin}).Info("creating new netns process")
 
-		if err := b.createNetwork(plugin); err != nil {
-			logrus.WithFields(logrus.Fields{"plugin": plugin}).Error(err)
+		// Warm up caches, IPAM state, etc. The results are thrown away.
+		for i := 0; i < warmup; i++ {
+			b.doLog = debug
+			if r := b.createNetwork(plugin, -1); r.Error != "" {
+				logrus.WithFields(logrus.Fields{"plugin": plugin}).Warnf("warmup iteration %d failed: %s", i, r.Error)
+			}
+		}
+
+		ps := newPluginStats(plugin)
+		for i := 0; !s.done(i, ps.add, ps.del); i++ {
+			// Only log the details of the first iteration.
+			b.doLog = i == 0 || debug
+
+			r := b.createNetwork(plugin, i)
+			if r.Error != "" {
+				logrus.WithFields(logrus.Fields{"plugin": plugin, "iteration": i}).Error(r.Error)
+			}
+			ps.record(r)
+			write(r)
+
+			if trace {
+				for _, command := range []string{"ADD", "DEL"} {
+					if err := printTrace(w, fmt.Sprintf("%s %s (iteration %d)", plugin, command, i), filterTrace(r.Trace, command)); err != nil {
+						logrus.Fatalf("printing trace failed: %v", err)
+					}
+				}
+			}
 		}
+		stats = append(stats, ps)
 	}
+	return stats
 }
 
 type benchmarkCNI struct {
 	originalNS    netns.NsHandle
 	libcni        cni.CNI
 	pluginConfDir string
+	pluginDirs    []string
 	binDir        string
 	doLog         bool
-	process       *os.Process
-	netnsFD       string
-	nsHandle      netns.NsHandle
+	target        *echoServer
+	tracer        *tracer
+	namespaces    nsProvider
+	// rendered are configuration files replacing the ones in pluginConfDir,
+	// written to renderDir along with the files they refer to.
+	rendered  map[string]string
+	renderDir string
 }
 
 func newCNIBenchmark(doLog bool) (*benchmarkCNI, error) {
@@ -125,55 +431,211 @@ func newCNIBenchmark(doLog bool) (*benchmarkCNI, error) {
 	binDir := filepath.Join(wd, "bin")
 	pluginDirs := []string{binDir, cni.DefaultCNIDir}
 	logrus.Debugf("Initializing new CNI library instance with configuration directory %s and plugin directories %s", pluginConfDir, strings.Join(pluginDirs, ", "))
-	libcni, err := cni.New(
-		cni.WithMinNetworkCount(2),
-		cni.WithPluginConfDir(pluginConfDir),
-		cni.WithPluginDir(pluginDirs),
-	)
+	libcni, err := newLibCNI(pluginConfDir, pluginDirs)
 	if err != nil {
-		return nil, fmt.Errorf("creating new CNI instance failed: %v", err)
+		return nil, err
+	}
+	namespaces, err := newNSProvider(nsProcess, binDir)
+	if err != nil {
+		return nil, err
 	}
 
 	return &benchmarkCNI{
 		originalNS:    originalNS,
 		libcni:        libcni,
 		pluginConfDir: pluginConfDir,
+		pluginDirs:    pluginDirs,
 		binDir:        binDir,
 		doLog:         doLog,
+		namespaces:    namespaces,
+		rendered:      map[string]string{},
 	}, nil
 }
 
-func (b *benchmarkCNI) createNetwork(plugin string) error {
-	if err := b.createProcess(plugin); err != nil {
+func newLibCNI(pluginConfDir string, pluginDirs []string) (cni.CNI, error) {
+	libcni, err := cni.New(
+		cni.WithMinNetworkCount(2),
+		cni.WithPluginConfDir(pluginConfDir),
+		cni.WithPluginDir(pluginDirs),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating new CNI instance failed: %v", err)
+	}
+
+	return libcni, nil
+}
+
+// enableTracing makes libcni execute the plugins through the trace shims.
+func (b *benchmarkCNI) enableTracing() error {
+	t, err := newTracer(b.pluginDirs)
+	if err != nil {
 		return err
 	}
-	defer b.process.Kill()
+	libcni, err := newLibCNI(b.pluginConfDir, []string{t.dir})
+	if err != nil {
+		t.Close()
+		return err
+	}
+	logrus.Debugf("Tracing plugin executions through the shims in %s", t.dir)
+
+	b.libcni = libcni
+	b.tracer = t
+	return nil
+}
+
+func (b *benchmarkCNI) createNetwork(plugin string, iteration int) *record {
+	r := &record{Plugin: plugin, Iteration: iteration}
 
-	if err := b.loadCNIConfig(plugin); err != nil {
+	var p *pod
+	if err := timed(&r.Timings.CreateNetNS, func() (err error) {
+		p, err = b.createPod(plugin)
 		return err
+	}); err != nil {
+		r.fail(err)
+		return r
 	}
+	// Only destroys the namespace if a step failed before the end.
+	defer p.Close()
 
-	result, err := b.setupNetNS()
+	if err := timed(&r.Timings.LoadCNIConfig, func() error {
+		return b.loadCNIConfig(plugin)
+	}); err != nil {
+		r.fail(err)
+		return r
+	}
+	config, err := b.renderedConfig(plugin)
 	if err != nil {
+		r.fail(err)
+		return r
+	}
+	r.Config = config
+
+	var traceOffset int64
+	if b.tracer != nil {
+		traceOffset = b.tracer.offset()
+	}
+
+	var before hostSnapshot
+	var ipamDirs []string
+	if checkLeaks {
+		var err error
+		if ipamDirs, err = b.ipamDirs(plugin); err != nil {
+			r.fail(err)
+			return r
+		}
+		if before, err = snapshotHost(ipamDirs); err != nil {
+			r.fail(fmt.Errorf("taking host snapshot before ADD failed: %v", err))
+			return r
+		}
+	}
+
+	var result *cni.CNIResult
+	setupErr := timed(&r.Timings.SetupNetNS, func() (err error) {
+		result, err = b.setupNetNS(p)
 		return err
+	})
+	r.fail(setupErr)
+	// After a failed ADD there is nothing to check, but whatever the plugin
+	// created before it failed still has to go.
+	if setupErr == nil {
+		b.checkNetwork(plugin, p, result, r)
+	}
+
+	// Always tear the network down, even if the checks failed.
+	r.fail(timed(&r.Timings.Remove, func() error {
+		return b.removeNetNS(p)
+	}))
+
+	// Check for leftovers while the netns is still around, killing the
+	// process would take the interfaces in it down with it.
+	if before != nil {
+		after, err := snapshotHost(ipamDirs)
+		if err != nil {
+			r.fail(fmt.Errorf("taking host snapshot after DEL failed: %v", err))
+		} else if r.Leaks = before.leaks(after); len(r.Leaks) > 0 {
+			logrus.WithFields(logrus.Fields{"plugin": plugin, "iteration": iteration}).Warnf("left behind after DEL: %s", strings.Join(r.Leaks, ", "))
+			if strict {
+				r.fail(fmt.Errorf("leaked %d host networking objects after DEL", len(r.Leaks)))
+			}
+		}
+	}
+
+	if b.tracer != nil {
+		entries, err := b.tracer.since(traceOffset, p.id())
+		r.fail(err)
+		if trace {
+			r.Trace = entries
+		}
+		if rusage {
+			r.Usage = newOperationUsage(entries)
+		}
+	}
+
+	r.fail(timed(&r.Timings.DestroyNetNS, p.Close))
+
+	return r
+}
+
+// checkNetwork records the result of a successful ADD, and whether the
+// network is ready, matches the result and works.
+func (b *benchmarkCNI) checkNetwork(plugin string, p *pod, result *cni.CNIResult, r *record) {
+	r.Result = newCNIResult(result)
+
+	// Some plugins return from ADD before traffic flows.
+	if readyTimeout > 0 {
+		err := timed(&r.Timings.Ready, func() (err error) {
+			r.Readiness, err = b.waitReady(p, result)
+			return err
+		})
+		r.fail(err)
+		// A timeout is not a first packet.
+		if err == nil && r.Readiness != nil {
+			r.Readiness.FirstPacket = r.Timings.SetupNetNS + r.Timings.Ready
+		}
 	}
-	defer b.libcni.Remove(fmt.Sprintf("%d", b.process.Pid), b.netnsFD)
-	defer b.nsHandle.Close()
 
-	// Get the IP of the default interface.
-	defaultInterface := cni.DefaultPrefix + "0"
-	ip := result.Interfaces[defaultInterface].IPConfigs[0].IP.String()
-	b.log(plugin, "IP of the default interface (%s) in the netns is %s", defaultInterface, ip)
+	// Make sure the plugin did what its result says.
+	mismatches, err := b.validateResult(p, result)
+	r.fail(err)
+	if r.Mismatches = mismatches; len(mismatches) > 0 {
+		r.fail(fmt.Errorf("result does not match the network namespace: %s", strings.Join(mismatches, "; ")))
+	}
+
+	r.fail(b.checkNetNS(plugin, p, result, r))
+
+	if dataPlane > 0 && r.Error == "" {
+		r.DataPlane, err = b.measureDataPlane(plugin, p, result)
+		r.fail(err)
+	}
+}
+
+// checkNetNS enters the network namespace and makes sure the network works.
+// It always returns to the original namespace.
+func (b *benchmarkCNI) checkNetNS(plugin string, p *pod, result *cni.CNIResult, r *record) error {
+	// Get the IPs of the default interface, one per address family.
+	ipConfigs, err := defaultIPConfigs(result)
+	if err != nil {
+		return err
+	}
+	ips := []string{}
+	for _, c := range result.Interfaces[cni.DefaultPrefix+"0"].IPConfigs {
+		ips = append(ips, c.IP.String())
+	}
+	b.log(plugin, "IPs of the default interface (%s0) in the netns are %s", cni.DefaultPrefix, strings.Join(ips, ", "))
 
 	// Switch into the new netns.
-	b.log(plugin, "performing setns into netns from pid %d", b.process.Pid)
-	if err := b.setNS(); err != nil {
+	b.log(plugin, "performing setns into netns %s", p.netnsFD)
+	if err := timed(&r.Timings.SetNS, p.setNS); err != nil {
 		return err
 	}
+	defer netns.Set(b.originalNS)
 
 	// Get a list of the links.
-	links, err := netlink.LinkList()
-	if err != nil {
+	var links []netlink.Link
+	if err := timed(&r.Timings.ListLinks, func() (err error) {
+		links, err = netlink.LinkList()
+		return err
+	}); err != nil {
 		return fmt.Errorf("getting list of ip links failed: %v", err)
 	}
 	l := []string{}
@@ -184,16 +646,37 @@ func (b *benchmarkCNI) createNetwork(plugin string) error {
 		b.log(plugin, "found netns ip links: %s", strings.Join(l, ", "))
 	}
 
-	// Try getting an outbound resource.
-	resp, err := http.Get("https://httpbin.org/ip")
-	if err != nil {
-		return fmt.Errorf("getting an out of network resource failed: %v", err)
+	// Make sure the network works by talking to the connectivity target over
+	// every address family. httpbin is only checked once.
+	if b.target.kind == targetHTTPBin {
+		ipConfigs = ipConfigs[:1]
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("reading response body failed: %v", err)
+	if err := timed(&r.Timings.Connectivity, func() error {
+		errs := []string{}
+		for _, c := range ipConfigs {
+			family := ipFamily(c.IP)
+			if !b.target.serves(family) {
+				b.log(plugin, "skipping the %s connectivity check, the %s target has no %s address", family, b.target.kind, family)
+				continue
+			}
+			var res *connectivityResult
+			if err := timed(r.Timings.familyConnectivity(family), func() (err error) {
+				res, err = b.target.check(c.Gateway, family)
+				return err
+			}); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", family, err))
+				continue
+			}
+			r.Connectivity = append(r.Connectivity, res)
+			b.log(plugin, "connectivity %s", res)
+		}
+		if len(errs) > 0 {
+			return errors.New(strings.Join(errs, "; "))
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("connectivity check failed: %v", err)
 	}
-	b.log(plugin, "httpbin returned: %s", strings.Replace(strings.Replace(strings.TrimSpace(string(body)), "\n", "", -1), " ", "", -1))
 
 	if err := netns.Set(b.originalNS); err != nil {
 		return fmt.Errorf("returning to original namespace failed: %v", err)
@@ -202,52 +685,50 @@ func (b *benchmarkCNI) createNetwork(plugin string) error {
 	return nil
 }
 
-func (b *benchmarkCNI) createProcess(plugin string) error {
-	// Create a process in a new network namespace.
-	cmd := exec.Command(filepath.Join(b.binDir, "sleeping-beauty"))
-	cmd.SysProcAttr = &syscall.SysProcAttr{Unshareflags: syscall.CLONE_NEWNET}
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("unsharing command failed: %v", err)
-	}
-	b.process = cmd.Process
-	b.netnsFD = fmt.Sprintf("/proc/%d/ns/net", cmd.Process.Pid)
-
-	newNS, err := netns.GetFromPid(cmd.Process.Pid)
+func (b *benchmarkCNI) createPod(plugin string) (*pod, error) {
+	// Create a new network namespace.
+	p, err := b.namespaces.newPod()
 	if err != nil {
-		return fmt.Errorf("creating new netns failed: %v", err)
+		return nil, err
 	}
-	b.nsHandle = newNS
 
-	b.log(plugin, "netns process has PID %d", cmd.Process.Pid)
+	if p.process != nil {
+		b.log(plugin, "netns process has PID %d", p.process.Pid)
+	} else {
+		b.log(plugin, "created netns %s", p.netnsFD)
+	}
 
-	return nil
+	return p, nil
 }
 
 func (b *benchmarkCNI) loadCNIConfig(plugin string) error {
-	// Load the CNI configuration.
-	if err := b.libcni.Load(
-		cni.WithLoNetwork,
-		cni.WithConfFile(filepath.Join(b.pluginConfDir, plugin+".conf")),
-	); err != nil {
+	// Load the CNI configuration, chained plugins come in a list.
+	file := b.confFile(plugin)
+	load := cni.WithConfFile(file)
+	if strings.HasSuffix(file, confListExt) {
+		load = cni.WithConfListFile(file)
+	}
+	if err := b.libcni.Load(cni.WithLoNetwork, load); err != nil {
 		return fmt.Errorf("loading CNI configuration failed: %v", err)
 	}
 
 	return nil
 }
 
-func (b *benchmarkCNI) setupNetNS() (*cni.CNIResult, error) {
+func (b *benchmarkCNI) setupNetNS(p *pod, opts ...cni.NamespaceOpts) (*cni.CNIResult, error) {
 	// Setup network for namespace.
-	result, err := b.libcni.Setup(fmt.Sprintf("%d", b.process.Pid), b.netnsFD)
+	result, err := b.libcni.Setup(p.id(), p.netnsFD, opts...)
 	if err != nil {
-		return nil, fmt.Errorf("setting up netns for id (%d) and netns (%s) failed: %v", b.process.Pid, b.netnsFD, err)
+		return nil, fmt.Errorf("setting up netns for id (%s) and netns (%s) failed: %v", p.id(), p.netnsFD, err)
 	}
 
 	return result, nil
 }
 
-func (b *benchmarkCNI) setNS() error {
-	if err := netns.Set(b.nsHandle); err != nil {
-		return fmt.Errorf("switching to new netns failed: %v", err)
+func (b *benchmarkCNI) removeNetNS(p *pod, opts ...cni.NamespaceOpts) error {
+	// Tear down the network for namespace.
+	if err := b.libcni.Remove(p.id(), p.netnsFD, opts...); err != nil {
+		return fmt.Errorf("removing netns for id (%s) and netns (%s) failed: %v", p.id(), p.netnsFD, err)
 	}
 
 	return nil
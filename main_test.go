@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"runtime"
 	"testing"
 
@@ -46,6 +45,16 @@ func BenchmarkCilium(b *testing.B) {
 	})
 }
 
+// You should run `make fake-cni` before running these benchmarks.
+func BenchmarkFake(b *testing.B) {
+	b.Run("setup network in netns", func(b *testing.B) {
+		runBenchmarkSetupNetNS(b, "fake")
+	})
+	b.Run("delete network from netns", func(b *testing.B) {
+		runBenchmarkDeleteNetwork(b, "fake")
+	})
+}
+
 // You should run `make run-flannel` before running these benchmarks.
 func BenchmarkFlannelIPvlan(b *testing.B) {
 	b.Run("setup network in netns", func(b *testing.B) {
@@ -84,6 +93,15 @@ func BenchmarkMacvlan(b *testing.B) {
 	})
 }
 
+func BenchmarkVlan(b *testing.B) {
+	b.Run("setup network in netns", func(b *testing.B) {
+		runBenchmarkSetupNetNS(b, "vlan")
+	})
+	b.Run("delete network from netns", func(b *testing.B) {
+		runBenchmarkDeleteNetwork(b, "vlan")
+	})
+}
+
 func BenchmarkPTP(b *testing.B) {
 	b.Run("setup network in netns", func(b *testing.B) {
 		runBenchmarkSetupNetNS(b, "ptp")
@@ -93,6 +111,24 @@ func BenchmarkPTP(b *testing.B) {
 	})
 }
 
+// The dual-stack and IPv6-only variants of the plugins using host-local.
+func BenchmarkIPv6(b *testing.B) {
+	for _, plugin := range []string{
+		"bridge-dualstack", "bridge-ipv6",
+		"ipvlan-dualstack", "ipvlan-ipv6",
+		"macvlan-dualstack", "macvlan-ipv6",
+		"ptp-dualstack", "ptp-ipv6",
+	} {
+		plugin := plugin
+		b.Run(plugin+"/setup network in netns", func(b *testing.B) {
+			runBenchmarkSetupNetNS(b, plugin)
+		})
+		b.Run(plugin+"/delete network from netns", func(b *testing.B) {
+			runBenchmarkDeleteNetwork(b, plugin)
+		})
+	}
+}
+
 // You should run `make run-weave` before running these benchmarks.
 func BenchmarkWeave(b *testing.B) {
 	b.Run("setup network in netns", func(b *testing.B) {
@@ -113,11 +149,25 @@ func runBenchmarkSetupNetNS(b *testing.B, plugin string) {
 		b.Fatal(err)
 	}
 	defer a.originalNS.Close()
+	defer a.removeRendered()
+	m := setupConfigs(b, a)
+	defer m.Close()
+	skipUnlessReady(b, a, plugin)
+
+	// The pod of the current iteration, a b.Fatal halfway through must
+	// not leave it attached.
+	var p *pod
+	defer func() {
+		if p != nil {
+			releasePod(a, p)
+		}
+	}()
 
 	b.ResetTimer()
 	b.StopTimer()
 	for i := 0; i < b.N; i++ {
-		if err := a.createProcess(plugin); err != nil {
+		p, err = a.createPod(plugin)
+		if err != nil {
 			b.Fatal(err)
 		}
 
@@ -126,13 +176,12 @@ func runBenchmarkSetupNetNS(b *testing.B, plugin string) {
 		}
 
 		b.StartTimer()
-		if _, err := a.setupNetNS(); err != nil {
+		if _, err := a.setupNetNS(p); err != nil {
 			b.Fatal(err)
 		}
 		b.StopTimer()
-		defer a.nsHandle.Close()
 
-		if err := a.setNS(); err != nil {
+		if err := p.setNS(); err != nil {
 			b.Fatal(err)
 		}
 
@@ -140,13 +189,14 @@ func runBenchmarkSetupNetNS(b *testing.B, plugin string) {
 			b.Fatalf("returning to original namespace failed: %v", err)
 		}
 
-		if err := a.libcni.Remove(fmt.Sprintf("%d", a.process.Pid), a.netnsFD); err != nil {
+		if err := a.removeNetNS(p); err != nil {
 			b.Fatal(err)
 		}
 
-		if err := a.process.Kill(); err != nil {
+		if err := p.Close(); err != nil {
 			b.Fatal(err)
 		}
+		p = nil
 	}
 }
 
@@ -160,11 +210,25 @@ func runBenchmarkDeleteNetwork(b *testing.B, plugin string) {
 		b.Fatal(err)
 	}
 	defer a.originalNS.Close()
+	defer a.removeRendered()
+	m := setupConfigs(b, a)
+	defer m.Close()
+	skipUnlessReady(b, a, plugin)
+
+	// The pod of the current iteration, a b.Fatal halfway through must
+	// not leave it attached.
+	var p *pod
+	defer func() {
+		if p != nil {
+			releasePod(a, p)
+		}
+	}()
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		b.StopTimer()
-		if err := a.createProcess(plugin); err != nil {
+		p, err = a.createPod(plugin)
+		if err != nil {
 			b.Fatal(err)
 		}
 
@@ -172,12 +236,11 @@ func runBenchmarkDeleteNetwork(b *testing.B, plugin string) {
 			b.Fatal(err)
 		}
 
-		if _, err := a.setupNetNS(); err != nil {
+		if _, err := a.setupNetNS(p); err != nil {
 			b.Fatal(err)
 		}
-		defer a.nsHandle.Close()
 
-		if err := a.setNS(); err != nil {
+		if err := p.setNS(); err != nil {
 			b.Fatal(err)
 		}
 
@@ -186,13 +249,47 @@ func runBenchmarkDeleteNetwork(b *testing.B, plugin string) {
 		}
 
 		b.StartTimer()
-		if err := a.libcni.Remove(fmt.Sprintf("%d", a.process.Pid), a.netnsFD); err != nil {
+		if err := a.removeNetNS(p); err != nil {
 			b.Fatal(err)
 		}
 		b.StopTimer()
 
-		if err := a.process.Kill(); err != nil {
+		if err := p.Close(); err != nil {
 			b.Fatal(err)
 		}
+		p = nil
+	}
+}
+
+// releasePod returns to the original namespace, DELs the network of a pod
+// and destroys it. The errors are ignored, the benchmark failed already.
+func releasePod(a *benchmarkCNI, p *pod) {
+	netns.Set(a.originalNS)
+	a.removeNetNS(p)
+	p.Close()
+}
+
+// skipUnlessReady skips the benchmark if the plugin is missing a binary, a
+// kernel module or a daemon, rather than failing halfway through.
+func skipUnlessReady(b *testing.B, a *benchmarkCNI, plugin string) {
+	if reason, _ := a.skipReason(plugin); reason != "" {
+		b.Skipf("skipping %s: %s", plugin, reason)
+	}
+}
+
+// setupConfigs renders the configuration templates and creates the master
+// like the program does, the master is returned to be closed.
+func setupConfigs(b *testing.B, a *benchmarkCNI) *master {
+	plugins, err := a.plugins()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := a.renderTemplates(plugins); err != nil {
+		b.Fatal(err)
+	}
+	m, err := a.setupMaster(plugins)
+	if err != nil {
+		b.Fatal(err)
 	}
+	return m
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// masterLink is the master the harness creates for the plugins that
+	// attach to one, masterPeer is the other end of the veth pair.
+	masterLink = "cnibench-m0"
+	masterPeer = "cnibench-m1"
+
+	// ethernetMTU is the MTU of the master on hosts without a default
+	// route.
+	ethernetMTU = 1500
+)
+
+// masterPlugins are the plugin types that create their devices on a master.
+var masterPlugins = map[string]bool{
+	"ipvlan":  true,
+	"macvlan": true,
+	"vlan":    true,
+}
+
+// master is the link created as the master of the configurations, so the
+// plugins never touch the NIC of the host.
+type master struct {
+	link netlink.Link
+	// peer is the host end of the veth pair, it holds the gateways of the
+	// configurations. It is nil when the master is a dummy.
+	peer netlink.Link
+}
+
+// setupMaster creates the master if one of the configurations uses it, and
+// adds the gateways of the configurations on the master to its peer. For
+// flannel the gateway is in the subnet file, so standInFlannel runs first.
+func (b *benchmarkCNI) setupMaster(plugins []string) (*master, error) {
+	type attachment struct {
+		vlan    int
+		subnets []*net.IPNet
+	}
+	attachments := []attachment{}
+	needed := false
+	for _, plugin := range plugins {
+		file, ok := b.rendered[plugin]
+		if !ok {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading rendered configuration of %s failed: %v", plugin, err)
+		}
+		conf := map[string]interface{}{}
+		if err := json.Unmarshal(data, &conf); err != nil {
+			return nil, fmt.Errorf("decoding rendered configuration of %s failed: %v", plugin, err)
+		}
+		for _, c := range pluginConfs(conf) {
+			// flannel delegates to a plugin on the master, but the subnet
+			// is the one in the flannel subnet file.
+			if delegate, ok := c["delegate"].(map[string]interface{}); ok && delegate["master"] == masterLink {
+				needed = true
+				file, _ := c["subnetFile"].(string)
+				if file == "" {
+					file = defaultFlannelSubnetFile
+				}
+				sn, err := readFlannelSubnet(file)
+				if err != nil {
+					logrus.Warnf("pods of %s on %s cannot reach the host: %v", plugin, masterLink, err)
+					continue
+				}
+				vlan, _ := delegate["vlanId"].(float64)
+				attachments = append(attachments, attachment{vlan: int(vlan), subnets: []*net.IPNet{sn}})
+			}
+			if t, _ := c["type"].(string); !masterPlugins[t] || c["master"] != masterLink {
+				continue
+			}
+			needed = true
+			ipam, err := json.Marshal(c["ipam"])
+			if err != nil {
+				return nil, fmt.Errorf("encoding configuration of %s failed: %v", plugin, err)
+			}
+			subnets, err := confSubnets(ipam)
+			if err != nil {
+				return nil, fmt.Errorf("parsing configuration of %s failed: %v", plugin, err)
+			}
+			vlan, _ := c["vlanId"].(float64)
+			attachments = append(attachments, attachment{vlan: int(vlan), subnets: subnets})
+		}
+	}
+	if !needed {
+		return nil, nil
+	}
+
+	mtu := ethernetMTU
+	if link, err := defaultRouteLink(); err == nil {
+		mtu = link.Attrs().MTU
+	}
+	m, err := newMaster(mtu)
+	if err != nil {
+		return nil, err
+	}
+	if m.peer == nil {
+		logrus.Warnf("the master %s is a dummy, pods on it cannot reach the host", masterLink)
+		return m, nil
+	}
+	// Without its gateway a configuration still runs, only the connectivity
+	// check fails.
+	for _, a := range attachments {
+		if err := m.addGateways(a.vlan, a.subnets); err != nil {
+			logrus.Warnf("pods on %s cannot reach the host: %v", masterLink, err)
+		}
+	}
+	logrus.Infof("Created %s as the master of the ipvlan, macvlan and vlan configurations", masterLink)
+	return m, nil
+}
+
+// newMaster creates the master. A veth pair makes the best master, the host
+// end holds the gateways so the connectivity checks get through. Fall back
+// to a dummy link, the way setupRootless does the other way around.
+func newMaster(mtu int) (*master, error) {
+	// Remove anything left over from a previous run.
+	if link, err := netlink.LinkByName(masterLink); err == nil {
+		netlink.LinkDel(link)
+	}
+
+	attrs := netlink.LinkAttrs{Name: masterLink, MTU: mtu}
+	if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: attrs, PeerName: masterPeer}); err != nil {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: attrs}); err != nil {
+			return nil, fmt.Errorf("creating master link %s failed: %v", masterLink, err)
+		}
+	}
+
+	m := &master{}
+	var err error
+	if m.link, err = netlink.LinkByName(masterLink); err != nil {
+		return nil, fmt.Errorf("getting master link %s failed: %v", masterLink, err)
+	}
+	if peer, err := netlink.LinkByName(masterPeer); err == nil {
+		m.peer = peer
+		if mtu > 0 {
+			if err := netlink.LinkSetMTU(peer, mtu); err != nil {
+				m.Close()
+				return nil, fmt.Errorf("setting the MTU of %s failed: %v", masterPeer, err)
+			}
+		}
+		if err := netlink.LinkSetUp(peer); err != nil {
+			m.Close()
+			return nil, fmt.Errorf("setting %s up failed: %v", masterPeer, err)
+		}
+	}
+	if err := netlink.LinkSetUp(m.link); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("setting master link %s up failed: %v", masterLink, err)
+	}
+	return m, nil
+}
+
+// addGateways adds the first address of every subnet, the gateway host-local
+// hands out, to the peer. Tagged traffic gets there through a vlan link on
+// the peer.
+func (m *master) addGateways(vlan int, subnets []*net.IPNet) error {
+	link := m.peer
+	if vlan > 0 {
+		name := fmt.Sprintf("cnibench-v%d", vlan)
+		l, err := netlink.LinkByName(name)
+		if err != nil {
+			v := &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: name, ParentIndex: m.peer.Attrs().Index}, VlanId: vlan}
+			if err := netlink.LinkAdd(v); err != nil {
+				return fmt.Errorf("creating vlan link %s failed: %v", name, err)
+			}
+			if l, err = netlink.LinkByName(name); err != nil {
+				return fmt.Errorf("getting vlan link %s failed: %v", name, err)
+			}
+			if err := netlink.LinkSetUp(l); err != nil {
+				return fmt.Errorf("setting vlan link %s up failed: %v", name, err)
+			}
+		}
+		link = l
+	}
+
+	for _, sn := range subnets {
+		addr := &netlink.Addr{IPNet: &net.IPNet{IP: nextIP(sn.IP), Mask: sn.Mask}}
+		// Without duplicate address detection the IPv6 gateway is usable
+		// right away.
+		if addr.IP.To4() == nil {
+			addr.Flags = unix.IFA_F_NODAD
+		}
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return fmt.Errorf("adding gateway %s to %s failed: %v", addr.IPNet, link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// Close deletes the master, along with its peer and the vlan links on it.
+func (m *master) Close() error {
+	if m == nil {
+		return nil
+	}
+	if err := netlink.LinkDel(m.link); err != nil {
+		return fmt.Errorf("deleting master link %s failed: %v", masterLink, err)
+	}
+	return nil
+}
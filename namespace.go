@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// nsProcess holds the network namespace with a process that unshared
+	// it, the plugins get /proc/<pid>/ns/net.
+	nsProcess = "process"
+	// nsNamed bind-mounts the network namespace under namedNSDir like
+	// `ip netns add` and most runtimes do.
+	nsNamed = "named"
+	// nsPause holds the network namespace with a process that has its own
+	// network, IPC, UTS, PID and mount namespaces like a pause container.
+	nsPause = "pause"
+
+	namedNSDir = "/var/run/netns"
+)
+
+// nsProvider creates the network namespaces of the pods.
+type nsProvider interface {
+	newPod() (*pod, error)
+}
+
+func newNSProvider(kind, binDir string) (nsProvider, error) {
+	switch kind {
+	case nsProcess:
+		return &processProvider{binDir: binDir, cloneflags: syscall.CLONE_NEWNET}, nil
+	case nsPause:
+		return &processProvider{
+			binDir:     binDir,
+			cloneflags: syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
+		}, nil
+	case nsNamed:
+		return &namedProvider{}, nil
+	}
+	return nil, fmt.Errorf("unknown netns provider %q, must be %s, %s or %s", kind, nsProcess, nsNamed, nsPause)
+}
+
+// pod is a network namespace the plugins attach their networks to.
+type pod struct {
+	containerID string
+	netnsFD     string
+	nsHandle    netns.NsHandle
+	// process holds the namespace, if there is one.
+	process *os.Process
+
+	destroy func() error
+	closed  bool
+}
+
+// id returns the container ID passed to the plugins.
+func (p *pod) id() string {
+	return p.containerID
+}
+
+func (p *pod) setNS() error {
+	if err := netns.Set(p.nsHandle); err != nil {
+		return fmt.Errorf("switching to new netns failed: %v", err)
+	}
+
+	return nil
+}
+
+// Close destroys the network namespace. It is safe to call more than once.
+func (p *pod) Close() error {
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	p.nsHandle.Close()
+	return p.destroy()
+}
+
+// processProvider starts sleeping-beauty in new namespaces.
+type processProvider struct {
+	binDir     string
+	cloneflags uintptr
+}
+
+func (pp *processProvider) newPod() (*pod, error) {
+	cmd := exec.Command(filepath.Join(pp.binDir, "sleeping-beauty"))
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: pp.cloneflags}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unsharing command failed: %v", err)
+	}
+	p := &pod{
+		containerID: fmt.Sprintf("%d", cmd.Process.Pid),
+		netnsFD:     fmt.Sprintf("/proc/%d/ns/net", cmd.Process.Pid),
+		process:     cmd.Process,
+		destroy: func() error {
+			if err := cmd.Process.Kill(); err != nil {
+				return fmt.Errorf("killing netns process %d failed: %v", cmd.Process.Pid, err)
+			}
+			// Reap it, the namespace only goes away with the process.
+			cmd.Wait()
+			return nil
+		},
+	}
+
+	newNS, err := netns.GetFromPid(cmd.Process.Pid)
+	if err != nil {
+		p.destroy()
+		return nil, fmt.Errorf("creating new netns failed: %v", err)
+	}
+	p.nsHandle = newNS
+
+	return p, nil
+}
+
+// namedProvider creates network namespaces in this process and bind-mounts
+// them under namedNSDir.
+type namedProvider struct {
+	count uint64
+}
+
+func (np *namedProvider) newPod() (*pod, error) {
+	name := fmt.Sprintf("cni-benchmarks-%d-%d", os.Getpid(), atomic.AddUint64(&np.count, 1))
+	path := filepath.Join(namedNSDir, name)
+
+	if err := os.MkdirAll(namedNSDir, 0755); err != nil {
+		return nil, fmt.Errorf("creating %s failed: %v", namedNSDir, err)
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return nil, fmt.Errorf("creating netns mount point %s failed: %v", path, err)
+	}
+	f.Close()
+
+	// Unshare on a thread of its own, the thread is thrown away when the
+	// goroutine exits without unlocking it, along with the namespace it is
+	// in.
+	errCh := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		ns, err := netns.New()
+		if err != nil {
+			errCh <- fmt.Errorf("unsharing netns failed: %v", err)
+			return
+		}
+		ns.Close()
+		src := fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid())
+		if err := unix.Mount(src, path, "none", unix.MS_BIND, ""); err != nil {
+			errCh <- fmt.Errorf("bind mounting netns to %s failed: %v", path, err)
+			return
+		}
+		errCh <- nil
+	}()
+	if err := <-errCh; err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	p := &pod{
+		containerID: name,
+		netnsFD:     path,
+		destroy: func() error {
+			if err := unix.Unmount(path, unix.MNT_DETACH); err != nil {
+				return fmt.Errorf("unmounting netns %s failed: %v", path, err)
+			}
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("removing netns %s failed: %v", path, err)
+			}
+			return nil
+		},
+	}
+
+	newNS, err := netns.GetFromPath(path)
+	if err != nil {
+		p.destroy()
+		return nil, fmt.Errorf("opening netns %s failed: %v", path, err)
+	}
+	p.nsHandle = newNS
+
+	return p, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	cni "github.com/containerd/go-cni"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	// Mapping i forwards hostPortBase+i on the host to containerPortBase+i
+	// in the pod.
+	hostPortBase      = 30000
+	containerPortBase = 8000
+
+	portMapTimeout = 2 * time.Second
+)
+
+// portMapResult is what the port forwarding check found.
+type portMapResult struct {
+	// Forwarded is how many mapped host ports reached the pod.
+	Forwarded int `json:"forwarded"`
+	// Hairpin is whether the pod reached itself through a host port.
+	Hairpin bool `json:"hairpin"`
+	// Latency is how long connecting to the first host port and getting an
+	// answer from the pod took.
+	Latency time.Duration `json:"latency"`
+}
+
+// portMapStats holds the ADD and DEL latencies with a number of mapped
+// ports.
+type portMapStats struct {
+	ports     int
+	add       *histogram
+	del       *histogram
+	failures  int
+	forwarded int
+	hairpins  int
+}
+
+// portMappings returns n TCP port mappings.
+func portMappings(n int) []cni.PortMapping {
+	mappings := []cni.PortMapping{}
+	for i := 0; i < n; i++ {
+		mappings = append(mappings, cni.PortMapping{
+			HostPort:      int32(hostPortBase + i),
+			ContainerPort: int32(containerPortBase + i),
+			Protocol:      "tcp",
+		})
+	}
+	return mappings
+}
+
+// chainsPortMap reports whether the configuration of a plugin has the
+// portmap plugin in its chain.
+func (b *benchmarkCNI) chainsPortMap(plugin string) bool {
+	types, err := b.pluginTypes(plugin)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if t == "portmap" {
+			return true
+		}
+	}
+	return false
+}
+
+// runPortMap runs the port mapping benchmark for every plugin chaining
+// portmap. For each count it measures -iterations ADD and DEL cycles of a
+// pod with that many mapped ports and checks they forward.
+func (b *benchmarkCNI) runPortMap(plugins []string, counts []int, write func(*record), w io.Writer) error {
+	b.doLog = debug
+
+	sort.Ints(counts)
+	for _, plugin := range plugins {
+		if !b.chainsPortMap(plugin) {
+			logrus.WithFields(logrus.Fields{"plugin": plugin}).Info("skipping, the configuration does not chain portmap")
+			continue
+		}
+		if err := b.loadCNIConfig(plugin); err != nil {
+			logrus.WithFields(logrus.Fields{"plugin": plugin}).Error(err)
+			continue
+		}
+
+		results := []*portMapStats{}
+		for _, n := range counts {
+			logrus.WithFields(logrus.Fields{"plugin": plugin, "ports": n}).Info("measuring port mappings")
+			s := &portMapStats{ports: n, add: newHistogram(), del: newHistogram()}
+			for i := 0; i < iterations; i++ {
+				r := b.portMapCycle(plugin, n)
+				r.Iteration = i
+				if r.PortMap != nil {
+					if r.PortMap.Forwarded == n {
+						s.forwarded++
+					}
+					if r.PortMap.Hairpin {
+						s.hairpins++
+					}
+				}
+				if r.Error != "" {
+					s.failures++
+					logrus.WithFields(logrus.Fields{"plugin": plugin, "ports": n}).Error(r.Error)
+				} else {
+					s.add.Record(r.Timings.SetupNetNS)
+					s.del.Record(r.Timings.Remove)
+				}
+				write(r)
+			}
+			results = append(results, s)
+		}
+
+		if err := printPortMap(w, plugin, results); err != nil {
+			return fmt.Errorf("printing port mapping results failed: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// portMapCycle creates a pod listening on n container ports, attaches the
+// network with n port mappings, checks they forward and tears it all down.
+func (b *benchmarkCNI) portMapCycle(plugin string, n int) *record {
+	r := &record{Plugin: plugin, Ports: n}
+
+	var p *pod
+	if err := timed(&r.Timings.CreateNetNS, func() (err error) {
+		p, err = b.createPod(plugin)
+		return err
+	}); err != nil {
+		r.fail(err)
+		return r
+	}
+	defer p.Close()
+
+	listeners, err := b.listenInPod(p, n)
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	if err != nil {
+		r.fail(err)
+		return r
+	}
+
+	opts := []cni.NamespaceOpts{cni.WithCapabilityPortMap(portMappings(n))}
+	var result *cni.CNIResult
+	if err := timed(&r.Timings.SetupNetNS, func() (err error) {
+		result, err = b.setupNetNS(p, opts...)
+		return err
+	}); err != nil {
+		r.fail(err)
+		// Try to clean up whatever got created, the chains of the
+		// mappings included.
+		b.removeNetNS(p, opts...)
+		return r
+	}
+	r.Result = newCNIResult(result)
+
+	if n > 0 {
+		r.PortMap, err = b.checkPortMap(p, result, n)
+		r.fail(err)
+	}
+
+	r.fail(timed(&r.Timings.Remove, func() error {
+		return b.removeNetNS(p, opts...)
+	}))
+	r.fail(timed(&r.Timings.DestroyNetNS, p.Close))
+
+	return r
+}
+
+// listenInPod starts n listeners in the pod network namespace. Each answers
+// every connection with its port.
+func (b *benchmarkCNI) listenInPod(p *pod, n int) ([]net.Listener, error) {
+	if err := p.setNS(); err != nil {
+		return nil, err
+	}
+	defer netns.Set(b.originalNS)
+
+	listeners := []net.Listener{}
+	for i := 0; i < n; i++ {
+		port := containerPortBase + i
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			return listeners, fmt.Errorf("listening on port %d in the pod failed: %v", port, err)
+		}
+		listeners = append(listeners, l)
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(c, "%d\n", port)
+				c.Close()
+			}
+		}()
+	}
+	return listeners, nil
+}
+
+// checkPortMap connects to every mapped host port from the host and to the
+// first one from the pod itself. The host ports are on the gateway, which
+// is an address of the host for bridge and ptp.
+func (b *benchmarkCNI) checkPortMap(p *pod, result *cni.CNIResult, n int) (*portMapResult, error) {
+	ipConfig, err := primaryIPConfig(result)
+	if err != nil || ipConfig.Gateway == nil {
+		return nil, fmt.Errorf("result has no gateway to reach the host ports on")
+	}
+	hostIP := ipConfig.Gateway
+
+	pm := &portMapResult{}
+	errs := []string{}
+	for i := 0; i < n; i++ {
+		start := time.Now()
+		if err := dialPort(hostIP, hostPortBase+i, containerPortBase+i); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if i == 0 {
+			pm.Latency = time.Since(start)
+		}
+		pm.Forwarded++
+	}
+	if pm.Forwarded < n {
+		return pm, fmt.Errorf("only %d of %d mapped ports reached the pod: %s", pm.Forwarded, n, strings.Join(errs, "; "))
+	}
+
+	// The hairpin case: the pod talks to itself through the host port.
+	if err := p.setNS(); err != nil {
+		return pm, err
+	}
+	err = dialPort(hostIP, hostPortBase, containerPortBase)
+	if err := netns.Set(b.originalNS); err != nil {
+		return pm, fmt.Errorf("returning to original namespace failed: %v", err)
+	}
+	if err != nil {
+		return pm, fmt.Errorf("hairpin: %v", err)
+	}
+	pm.Hairpin = true
+
+	return pm, nil
+}
+
+// dialPort connects to ip:port and checks the answer comes from the
+// listener on the expected container port.
+func dialPort(ip net.IP, port, expected int) error {
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	c, err := net.DialTimeout("tcp", addr, portMapTimeout)
+	if err != nil {
+		return fmt.Errorf("dialing host port %s failed: %v", addr, err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(portMapTimeout))
+
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("reading from host port %s failed: %v", addr, err)
+	}
+	if got := strings.TrimSpace(line); got != strconv.Itoa(expected) {
+		return fmt.Errorf("host port %s reached container port %s, expected %d", addr, got, expected)
+	}
+	return nil
+}
+
+// printPortMap writes a table of the ADD and DEL latency by number of mapped
+// ports. The cost is relative to the smallest number of ports, pass 0 to
+// get the cost of port mapping itself.
+func printPortMap(w io.Writer, plugin string, results []*portMapStats) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 10, 1, 3, ' ', 0)
+	fmt.Fprintln(tw, "PLUGIN\tPORTS\tN\tFAILED\tFORWARDED\tHAIRPIN\tADD MEAN\tADD COST\tDEL MEAN\tDEL COST")
+	base := results[0]
+	for _, s := range results {
+		runs := s.add.Count() + int64(s.failures)
+		forwarded, hairpin := "-", "-"
+		if s.ports > 0 {
+			forwarded = fmt.Sprintf("%d/%d", s.forwarded, runs)
+			hairpin = fmt.Sprintf("%d/%d", s.hairpins, runs)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			plugin, s.ports, s.add.Count(), s.failures, forwarded, hairpin,
+			round(s.add.Mean()), cost(s.add.Mean()-base.add.Mean()),
+			round(s.del.Mean()), cost(s.del.Mean()-base.del.Mean()))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// cost returns a duration with its sign.
+func cost(d time.Duration) string {
+	if d < 0 {
+		return round(d).String()
+	}
+	return "+" + round(d).String()
+}
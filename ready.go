@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	cni "github.com/containerd/go-cni"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// readyProbeTimeout bounds a single readiness probe, a plugin that is not
+// ready yet usually drops the SYN rather than refusing it.
+const readyProbeTimeout = 100 * time.Millisecond
+
+// neighResolved are the neighbor states with a link-layer address.
+const neighResolved = netlink.NUD_REACHABLE | netlink.NUD_STALE | netlink.NUD_DELAY | netlink.NUD_PROBE | netlink.NUD_PERMANENT
+
+// readiness is when traffic first flowed after ADD returned.
+type readiness struct {
+	// FirstPacket is from the start of ADD to the first successful probe,
+	// ADD returning is timings.SetupNetNS.
+	FirstPacket time.Duration `json:"firstPacket"`
+	// Probes is how many probes it took.
+	Probes int `json:"probes"`
+}
+
+// waitReady probes from inside the pod on a tight loop until, for every
+// address family of the pod, the gateway is resolved and a TCP connection to
+// the echo server gets through, or -ready runs out. It always returns to the
+// original namespace.
+func (b *benchmarkCNI) waitReady(p *pod, result *cni.CNIResult) (*readiness, error) {
+	if b.target.tcpListener == nil {
+		return nil, fmt.Errorf("the readiness probe needs a local target, not %s", b.target.kind)
+	}
+	ipConfigs, err := defaultIPConfigs(result)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.setNS(); err != nil {
+		return nil, err
+	}
+	defer netns.Set(b.originalNS)
+
+	// Devices without ARP, like the ipvlan L3 modes, have nothing to
+	// resolve.
+	defaultInterface := cni.DefaultPrefix + "0"
+	link, err := netlink.LinkByName(defaultInterface)
+	if err != nil {
+		return nil, fmt.Errorf("getting %s in netns failed: %v", defaultInterface, err)
+	}
+	if link.Attrs().RawFlags&unix.IFF_NOARP != 0 {
+		link = nil
+	}
+
+	rd := &readiness{}
+	deadline := time.Now().Add(readyTimeout)
+	for _, c := range ipConfigs {
+		family := ipFamily(c.IP)
+		ip, err := b.target.address(c.Gateway, family)
+		if err != nil {
+			return nil, err
+		}
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(b.target.tcpListener.Addr().(*net.TCPAddr).Port))
+
+		for {
+			rd.Probes++
+			err := probeReady(addr, c.Gateway, link, deadline)
+			if err == nil {
+				break
+			}
+			if !time.Now().Before(deadline) {
+				return rd, fmt.Errorf("%s not ready after %s and %d probes: %v", family, readyTimeout, rd.Probes, err)
+			}
+		}
+	}
+	return rd, nil
+}
+
+// probeReady connects to addr, then checks the gateway has been resolved on
+// link by ARP or neighbor discovery. Connecting is what makes the kernel
+// resolve it.
+func probeReady(addr string, gateway net.IP, link netlink.Link, deadline time.Time) error {
+	timeout := readyProbeTimeout
+	if left := time.Until(deadline); left < timeout {
+		timeout = left
+	}
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	c.Close()
+
+	if link == nil || gateway == nil {
+		return nil
+	}
+	neighbors, err := netlink.NeighList(link.Attrs().Index, netlinkFamily(ipFamily(gateway)))
+	if err != nil {
+		return fmt.Errorf("listing neighbors failed: %v", err)
+	}
+	for _, n := range neighbors {
+		if n.IP.Equal(gateway) && n.State&neighResolved != 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("gateway %s is not resolved", gateway)
+}
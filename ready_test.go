@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProbeReady(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	deadline := time.Now().Add(time.Second)
+
+	if err := probeReady(addr, nil, nil, deadline); err != nil {
+		t.Fatalf("expected the probe to get through, got %v", err)
+	}
+
+	l.Close()
+	if err := probeReady(addr, nil, nil, deadline); err == nil {
+		t.Fatal("expected the probe to fail without a listener")
+	}
+}
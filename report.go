@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cni "github.com/containerd/go-cni"
+)
+
+const (
+	outputJSON = "json"
+	outputCSV  = "csv"
+)
+
+// record is the result of running one plugin once. All durations are in
+// nanoseconds when encoded.
+type record struct {
+	Plugin       string                `json:"plugin"`
+	Iteration    int                   `json:"iteration"`
+	Concurrency  int                   `json:"concurrency,omitempty"`
+	Attachments  int                   `json:"attachments,omitempty"`
+	Ports        int                   `json:"ports,omitempty"`
+	Rate         int                   `json:"rate,omitempty"`
+	CNIVersion   string                `json:"cniVersion,omitempty"`
+	Config       json.RawMessage       `json:"config,omitempty"`
+	Timings      timings               `json:"timings"`
+	Result       *cniResult            `json:"result,omitempty"`
+	Readiness    *readiness            `json:"readiness,omitempty"`
+	Connectivity []*connectivityResult `json:"connectivity,omitempty"`
+	PortMap      *portMapResult        `json:"portMap,omitempty"`
+	Bandwidth    *bandwidthResult      `json:"bandwidth,omitempty"`
+	DataPlane    *dataPlaneResult      `json:"dataPlane,omitempty"`
+	Usage        *operationUsage       `json:"usage,omitempty"`
+	Trace        []*execTrace          `json:"trace,omitempty"`
+	Mismatches   []string              `json:"mismatches,omitempty"`
+	Conformance  []*conformanceResult  `json:"conformance,omitempty"`
+	Leaks        []string              `json:"leaks,omitempty"`
+	Skipped      string                `json:"skipped,omitempty"`
+	Unmet        []string              `json:"unmet,omitempty"`
+	Error        string                `json:"error,omitempty"`
+}
+
+// fail records err on the record. The first error is kept first, later
+// errors (usually from cleanup) are appended.
+func (r *record) fail(err error) {
+	if err == nil {
+		return
+	}
+	if r.Error == "" {
+		r.Error = err.Error()
+		return
+	}
+	r.Error += "; " + err.Error()
+}
+
+// timings holds how long each step of createNetwork took.
+type timings struct {
+	CreateNetNS   time.Duration `json:"createNetNS"`
+	LoadCNIConfig time.Duration `json:"loadCNIConfig"`
+	SetupNetNS    time.Duration `json:"setupNetNS"`
+	Ready         time.Duration `json:"ready"`
+	SetNS         time.Duration `json:"setNS"`
+	ListLinks     time.Duration `json:"listLinks"`
+	Connectivity  time.Duration `json:"connectivity"`
+	// The connectivity check by address family.
+	ConnectivityV4 time.Duration `json:"connectivityV4"`
+	ConnectivityV6 time.Duration `json:"connectivityV6"`
+	Remove         time.Duration `json:"remove"`
+	DestroyNetNS   time.Duration `json:"destroyNetNS"`
+}
+
+// firstPacketPhase is the name the first packet latency of the readiness
+// probes is reported and compared under, next to the phases.
+const firstPacketPhase = "firstPacket"
+
+// oldPhaseNames are the names phases had in reports written before they
+// were renamed, createNetNS was createProcess before the network namespace
+// providers.
+var oldPhaseNames = map[string]string{
+	"createNetNS": "createProcess",
+}
+
+// UnmarshalJSON reads the timings of reports written with the old phase
+// names as well.
+func (t *timings) UnmarshalJSON(b []byte) error {
+	type plain timings
+	var old struct {
+		plain
+		CreateProcess time.Duration `json:"createProcess"`
+	}
+	if err := json.Unmarshal(b, &old); err != nil {
+		return err
+	}
+	*t = timings(old.plain)
+	if t.CreateNetNS == 0 {
+		t.CreateNetNS = old.CreateProcess
+	}
+	return nil
+}
+
+// phase is a named step of createNetwork.
+type phase struct {
+	Name     string
+	Duration time.Duration
+}
+
+// phases returns the timings in the order the steps run.
+func (t timings) phases() []phase {
+	return []phase{
+		{"createNetNS", t.CreateNetNS},
+		{"loadCNIConfig", t.LoadCNIConfig},
+		{"setupNetNS", t.SetupNetNS},
+		{"ready", t.Ready},
+		{"setNS", t.SetNS},
+		{"listLinks", t.ListLinks},
+		{"connectivity", t.Connectivity},
+		{"connectivityV4", t.ConnectivityV4},
+		{"connectivityV6", t.ConnectivityV6},
+		{"remove", t.Remove},
+		{"destroyNetNS", t.DestroyNetNS},
+	}
+}
+
+// familyConnectivity returns the connectivity timing of an address family.
+func (t *timings) familyConnectivity(family string) *time.Duration {
+	if family == familyV6 {
+		return &t.ConnectivityV6
+	}
+	return &t.ConnectivityV4
+}
+
+// timed runs fn and stores how long it took in d.
+func timed(d *time.Duration, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	*d = time.Since(start)
+	return err
+}
+
+// cniResult is the part of the CNI result we keep in the report.
+type cniResult struct {
+	Interfaces []cniInterface `json:"interfaces"`
+	Routes     []string       `json:"routes,omitempty"`
+}
+
+type cniInterface struct {
+	Name    string   `json:"name"`
+	Mac     string   `json:"mac,omitempty"`
+	Sandbox string   `json:"sandbox,omitempty"`
+	IPs     []string `json:"ips,omitempty"`
+	Gateway []string `json:"gateway,omitempty"`
+}
+
+func newCNIResult(result *cni.CNIResult) *cniResult {
+	r := &cniResult{}
+	for name, iface := range result.Interfaces {
+		i := cniInterface{
+			Name:    name,
+			Mac:     iface.Mac,
+			Sandbox: iface.Sandbox,
+		}
+		for _, ip := range iface.IPConfigs {
+			i.IPs = append(i.IPs, ip.IP.String())
+			if ip.Gateway != nil {
+				i.Gateway = append(i.Gateway, ip.Gateway.String())
+			}
+		}
+		r.Interfaces = append(r.Interfaces, i)
+	}
+	sort.Slice(r.Interfaces, func(i, j int) bool {
+		return r.Interfaces[i].Name < r.Interfaces[j].Name
+	})
+	for _, route := range result.Routes {
+		r.Routes = append(r.Routes, route.String())
+	}
+	return r
+}
+
+// String returns the interfaces and their IPs as name=ip,ip;name=ip.
+func (r *cniResult) String() string {
+	if r == nil {
+		return ""
+	}
+	ifaces := []string{}
+	for _, i := range r.Interfaces {
+		ifaces = append(ifaces, fmt.Sprintf("%s=%s", i.Name, strings.Join(i.IPs, ",")))
+	}
+	return strings.Join(ifaces, ";")
+}
+
+// reportWriter writes records in a machine-readable format.
+type reportWriter interface {
+	Write(r *record) error
+	Flush() error
+}
+
+func newReportWriter(format string, w io.Writer) (reportWriter, error) {
+	switch format {
+	case outputJSON:
+		return &jsonWriter{enc: json.NewEncoder(w)}, nil
+	case outputCSV:
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q, must be %s or %s", format, outputJSON, outputCSV)
+}
+
+// jsonWriter writes one JSON object per line.
+type jsonWriter struct {
+	enc *json.Encoder
+}
+
+func (j *jsonWriter) Write(r *record) error {
+	return j.enc.Encode(r)
+}
+
+func (j *jsonWriter) Flush() error {
+	return nil
+}
+
+// csvWriter writes one row per record, with the timings in nanoseconds.
+type csvWriter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func (c *csvWriter) Write(r *record) error {
+	if !c.wroteHeader {
+		header := []string{"plugin", "iteration", "concurrency", "attachments", "ports", "rate", "cniVersion", "config"}
+		for _, p := range r.Timings.phases() {
+			header = append(header, p.Name)
+		}
+		header = append(header, firstPacketPhase)
+		for _, op := range []string{"add", "del"} {
+			for _, name := range usageColumns {
+				header = append(header, op+name)
+			}
+		}
+		for _, path := range []string{"podToPod", "podToHost"} {
+			for _, name := range trafficColumns {
+				header = append(header, path+name)
+			}
+		}
+		header = append(header, "interfaces", "routes", "sourceIP", "mismatches", "conformance", "leaks", "skipped", "error")
+		if err := c.w.Write(header); err != nil {
+			return err
+		}
+		c.wroteHeader = true
+	}
+
+	row := []string{r.Plugin, strconv.Itoa(r.Iteration), strconv.Itoa(r.Concurrency), strconv.Itoa(r.Attachments), strconv.Itoa(r.Ports), strconv.Itoa(r.Rate), r.CNIVersion, string(r.Config)}
+	for _, p := range r.Timings.phases() {
+		row = append(row, strconv.FormatInt(int64(p.Duration), 10))
+	}
+	firstPacket := ""
+	if r.Readiness != nil && r.Readiness.FirstPacket > 0 {
+		firstPacket = strconv.FormatInt(int64(r.Readiness.FirstPacket), 10)
+	}
+	row = append(row, firstPacket)
+	var add, del *resourceUsage
+	if r.Usage != nil {
+		add, del = r.Usage.Add, r.Usage.Del
+	}
+	row = append(row, usageRow(add)...)
+	row = append(row, usageRow(del)...)
+	var podToPod, podToHost *trafficResult
+	if r.DataPlane != nil {
+		podToPod, podToHost = r.DataPlane.PodToPod, r.DataPlane.PodToHost
+	}
+	row = append(row, trafficRow(podToPod)...)
+	row = append(row, trafficRow(podToHost)...)
+	routes := ""
+	if r.Result != nil {
+		routes = strings.Join(r.Result.Routes, ";")
+	}
+	sourceIPs := []string{}
+	for _, c := range r.Connectivity {
+		sourceIPs = append(sourceIPs, c.SourceIP)
+	}
+	row = append(row, r.Result.String(), routes, strings.Join(sourceIPs, ";"), strings.Join(r.Mismatches, ";"), conformanceString(r.Conformance), strings.Join(r.Leaks, ";"), r.Skipped, r.Error)
+	return c.w.Write(row)
+}
+
+// usageColumns are the resource usage columns, prefixed with add or del.
+var usageColumns = []string{"UserCPU", "SystemCPU", "MaxRSS", "VoluntaryCtxSwitches", "InvoluntaryCtxSwitches", "MinorFaults", "MajorFaults"}
+
+// usageRow returns the usage columns, they are empty when the usage was not
+// recorded.
+func usageRow(u *resourceUsage) []string {
+	if u == nil {
+		return make([]string, len(usageColumns))
+	}
+	return []string{
+		strconv.FormatInt(int64(u.UserCPU), 10),
+		strconv.FormatInt(int64(u.SystemCPU), 10),
+		strconv.FormatInt(u.MaxRSS, 10),
+		strconv.FormatInt(u.VoluntaryCtxSwitches, 10),
+		strconv.FormatInt(u.InvoluntaryCtxSwitches, 10),
+		strconv.FormatInt(u.MinorFaults, 10),
+		strconv.FormatInt(u.MajorFaults, 10),
+	}
+}
+
+// trafficColumns are the data-plane columns, prefixed with the path.
+var trafficColumns = []string{"TCPThroughput", "UDPPacketRate", "UDPLoss", "LatencyP50", "LatencyP90", "LatencyP99", "ConnectionRate"}
+
+// trafficRow returns the data-plane columns, they are empty when the path was
+// not measured or did not work.
+func trafficRow(t *trafficResult) []string {
+	if t == nil || t.Error != "" {
+		return make([]string, len(trafficColumns))
+	}
+	return []string{
+		strconv.FormatFloat(t.TCPThroughput, 'f', 0, 64),
+		strconv.FormatFloat(t.UDPPacketRate, 'f', 0, 64),
+		strconv.FormatFloat(t.UDPLoss, 'f', 4, 64),
+		strconv.FormatInt(int64(t.LatencyP50), 10),
+		strconv.FormatInt(int64(t.LatencyP90), 10),
+		strconv.FormatInt(int64(t.LatencyP99), 10),
+		strconv.FormatFloat(t.ConnectionRate, 'f', 0, 64),
+	}
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
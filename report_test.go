@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportWriter(t *testing.T) {
+	r := &record{
+		Plugin:    "bridge",
+		Iteration: 2,
+		Timings: timings{
+			SetupNetNS: 3 * time.Millisecond,
+			Remove:     time.Millisecond,
+		},
+		Result: &cniResult{
+			Interfaces: []cniInterface{
+				{Name: "eth0", IPs: []string{"10.10.0.2"}},
+			},
+		},
+		Error: "boom",
+	}
+
+	var buf bytes.Buffer
+	w, err := newReportWriter(outputCSV, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a header and one row, got %d lines", len(lines))
+	}
+	expected := "bridge,2,0,0,0,0,,,0,0,3000000,0,0,0,0,0,0,1000000,0,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,eth0=10.10.0.2,,,,,,,boom"
+	if lines[1] != expected {
+		t.Fatalf("expected csv row %q, got %q", expected, lines[1])
+	}
+
+	buf.Reset()
+	w, err = newReportWriter(outputJSON, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(r); err != nil {
+		t.Fatal(err)
+	}
+	var decoded record
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Timings.SetupNetNS != r.Timings.SetupNetNS || decoded.Error != r.Error {
+		t.Fatalf("expected %#v, got %#v", r, decoded)
+	}
+
+	if _, err := newReportWriter("xml", &buf); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// rootlessEnv is set in the re-executed process running in the user
+// namespace.
+const rootlessEnv = "CNI_BENCHMARKS_ROOTLESS"
+
+// rootlessMasterLink is the link created in the private host network
+// namespace for macvlan, ipvlan and vlan to attach to, rootlessMaster is its
+// address.
+const rootlessMasterLink = "eth0"
+
+var rootlessMaster = &net.IPNet{IP: net.IPv4(192, 0, 2, 1), Mask: net.CIDRMask(24, 32)}
+
+// rootlessPlugins are the plugin types that work with the privileges of
+// root in a user namespace. The rest need root on the host or a daemon.
+var rootlessPlugins = map[string]bool{
+	"bridge":   true,
+	"ptp":      true,
+	"macvlan":  true,
+	"ipvlan":   true,
+	"vlan":     true,
+	"fake-cni": true,
+}
+
+// inRootlessNS reports whether this is the re-executed process.
+func inRootlessNS() bool {
+	return os.Getenv(rootlessEnv) != ""
+}
+
+// reexecRootless runs this binary again with the same arguments as root in
+// a new user namespace, with its own network and mount namespaces, and
+// returns its exit status.
+func reexecRootless() int {
+	self, err := os.Executable()
+	if err != nil {
+		logrus.Fatalf("finding the cni-benchmarks binary failed: %v", err)
+	}
+
+	cmd := exec.Command(self, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), rootlessEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET | syscall.CLONE_NEWNS,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+		},
+		// Unprivileged users can only map their gid with setgroups
+		// disabled.
+		GidMappingsEnableSetgroups: false,
+	}
+
+	if err := cmd.Start(); err != nil {
+		logrus.Fatalf("creating user namespace failed: %v (are unprivileged user namespaces enabled?)", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+		}
+		logrus.Fatal(err)
+	}
+	return 0
+}
+
+// setupRootless prepares the private host network namespace and mount
+// namespace of the re-executed process: loopback up, an eth0 for macvlan and
+// ipvlan, and a tmpfs on /run so IPAM state and named network namespaces can
+// be written.
+func setupRootless() error {
+	// Keep our mounts from propagating back to the host.
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private failed: %v", err)
+	}
+	if err := unix.Mount("tmpfs", "/run", "tmpfs", 0, "mode=0755"); err != nil {
+		return fmt.Errorf("mounting tmpfs on /run failed: %v", err)
+	}
+	// Without write access to /var/lib the directory cannot be created,
+	// rootlessDataDirs moves the reservations to /run then.
+	if err := os.MkdirAll(defaultIPAMDataDir, 0755); err == nil {
+		if err := unix.Mount("tmpfs", defaultIPAMDataDir, "tmpfs", 0, "mode=0755"); err != nil {
+			return fmt.Errorf("mounting tmpfs on %s failed: %v", defaultIPAMDataDir, err)
+		}
+	}
+
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("looking up loopback failed: %v", err)
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("setting loopback up failed: %v", err)
+	}
+
+	// A dummy link makes the best master, not every kernel has them so fall
+	// back to one end of a veth pair.
+	attrs := netlink.LinkAttrs{Name: rootlessMasterLink}
+	if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: attrs}); err != nil {
+		if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: attrs, PeerName: "eth0-peer"}); err != nil {
+			return fmt.Errorf("creating master link eth0 failed: %v", err)
+		}
+		if peer, err := netlink.LinkByName("eth0-peer"); err == nil {
+			netlink.LinkSetUp(peer)
+		}
+	}
+	master, err := netlink.LinkByName(rootlessMasterLink)
+	if err != nil {
+		return fmt.Errorf("looking up master link eth0 failed: %v", err)
+	}
+	if err := netlink.AddrAdd(master, &netlink.Addr{IPNet: rootlessMaster}); err != nil {
+		return fmt.Errorf("adding address to master link eth0 failed: %v", err)
+	}
+	if err := netlink.LinkSetUp(master); err != nil {
+		return fmt.Errorf("setting master link eth0 up failed: %v", err)
+	}
+
+	logrus.Info("Running rootless in a user namespace")
+	return nil
+}
+
+// rootlessDataDirs points host-local at the tmpfs on /run in the
+// configurations that keep their reservations in defaultIPAMDataDir, when
+// setupRootless could not mount over it.
+func (b *benchmarkCNI) rootlessDataDirs(plugins []string) error {
+	if !inRootlessNS() {
+		return nil
+	}
+	if fi, err := os.Stat(defaultIPAMDataDir); err == nil && fi.IsDir() {
+		return nil
+	}
+
+	for _, plugin := range plugins {
+		dirs, err := b.ipamDirs(plugin)
+		if err != nil {
+			return err
+		}
+		moved := false
+		for _, dir := range dirs {
+			moved = moved || strings.HasPrefix(dir, defaultIPAMDataDir)
+		}
+		if !moved {
+			continue
+		}
+		dataDir := filepath.Join("/run/cni", plugin, "container-ipam-state")
+		if err := b.render(plugin, func(conf map[string]interface{}) error {
+			for _, c := range pluginConfs(conf) {
+				ipam, ok := c["ipam"].(map[string]interface{})
+				if ok && ipam["type"] == "host-local" && (ipam["dataDir"] == nil || ipam["dataDir"] == "") {
+					ipam["dataDir"] = dataDir
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{"plugin": plugin}).Infof("keeping the IPAM reservations in %s, %s cannot be created rootless", dataDir, defaultIPAMDataDir)
+	}
+	return nil
+}
+
+// skipReason returns why a plugin cannot run and the prerequisites it is
+// missing, or nothing if it can.
+func (b *benchmarkCNI) skipReason(plugin string) (string, []string) {
+	if inRootlessNS() {
+		types, err := b.pluginTypes(plugin)
+		if err != nil {
+			return err.Error(), nil
+		}
+		for _, t := range types {
+			if !rootlessPlugins[t] {
+				return fmt.Sprintf("the %s plugin does not work rootless", t), nil
+			}
+		}
+	}
+	if unmet := b.unmetPrerequisites(plugin); len(unmet) > 0 {
+		return "prerequisites not met: " + strings.Join(unmet, "; "), unmet
+	}
+	return "", nil
+}
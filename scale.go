@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// chartWidth is the width of the longest bar in the scale chart.
+const chartWidth = 50
+
+// scaleResult holds the ADD and DEL latencies of one more pod while k pods
+// are already attached.
+type scaleResult struct {
+	k        int
+	add      *histogram
+	del      *histogram
+	failures int
+}
+
+// runScale runs the scale benchmark for every plugin. For each k it keeps k
+// pods attached and measures -iterations ADD and DEL cycles of the k+1th
+// pod.
+func (b *benchmarkCNI) runScale(plugins []string, ks []int, write func(*record), w io.Writer) error {
+	// Logging every background pod is just noise.
+	b.doLog = debug
+
+	sort.Ints(ks)
+	for _, plugin := range plugins {
+		if err := b.loadCNIConfig(plugin); err != nil {
+			logrus.WithFields(logrus.Fields{"plugin": plugin}).Error(err)
+			continue
+		}
+
+		results := b.scale(plugin, ks, write)
+		if err := printScale(w, plugin, results); err != nil {
+			return fmt.Errorf("printing scale results failed: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// scale grows the number of attached pods through ks and measures the ADD
+// and DEL of one more pod at each step. The plugin configuration must
+// already be loaded.
+func (b *benchmarkCNI) scale(plugin string, ks []int, write func(*record)) []*scaleResult {
+	attached := []*pod{}
+	defer func() {
+		logrus.WithFields(logrus.Fields{"plugin": plugin}).Infof("removing %d attached pods", len(attached))
+		for _, p := range attached {
+			if err := b.removeNetNS(p); err != nil {
+				logrus.WithFields(logrus.Fields{"plugin": plugin}).Warn(err)
+			}
+			p.Close()
+		}
+	}()
+
+	results := []*scaleResult{}
+	for _, k := range ks {
+		// Attach pods until there are k of them.
+		for len(attached) < k {
+			p, err := b.createPod(plugin)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{"plugin": plugin}).Errorf("creating attached pod %d failed: %v", len(attached)+1, err)
+				return results
+			}
+			if _, err := b.setupNetNS(p); err != nil {
+				p.Close()
+				logrus.WithFields(logrus.Fields{"plugin": plugin}).Errorf("attaching pod %d failed: %v", len(attached)+1, err)
+				return results
+			}
+			attached = append(attached, p)
+		}
+		logrus.WithFields(logrus.Fields{"plugin": plugin, "attached": k}).Info("measuring the next pod")
+
+		sr := &scaleResult{k: k, add: newHistogram(), del: newHistogram()}
+		for i := 0; i < iterations; i++ {
+			r := b.churnCycle(plugin)
+			r.Iteration = i
+			r.Attachments = k
+			if r.Error != "" {
+				sr.failures++
+				logrus.WithFields(logrus.Fields{"plugin": plugin, "attached": k}).Error(r.Error)
+			} else {
+				sr.add.Record(r.Timings.SetupNetNS)
+				sr.del.Record(r.Timings.Remove)
+			}
+			write(r)
+		}
+		results = append(results, sr)
+	}
+
+	return results
+}
+
+// printScale writes a table of the ADD and DEL latency for each number of
+// attached pods, followed by a chart of the mean ADD and DEL latency.
+func printScale(w io.Writer, plugin string, results []*scaleResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 10, 1, 3, ' ', 0)
+	fmt.Fprintln(tw, "PLUGIN\tATTACHED\tN\tFAILED\tADD MEAN\tADD P50\tADD P99\tDEL MEAN\tDEL P50\tDEL P99")
+	var longest time.Duration
+	for _, s := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			plugin, s.k, s.add.Count(), s.failures,
+			round(s.add.Mean()), round(s.add.Percentile(50)), round(s.add.Percentile(99)),
+			round(s.del.Mean()), round(s.del.Percentile(50)), round(s.del.Percentile(99)))
+		if s.add.Mean() > longest {
+			longest = s.add.Mean()
+		}
+		if s.del.Mean() > longest {
+			longest = s.del.Mean()
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\n%s: mean latency of the next pod by number of attached pods\n", plugin)
+	tw = tabwriter.NewWriter(w, 0, 1, 1, ' ', 0)
+	for _, s := range results {
+		fmt.Fprintf(tw, "%d\tADD\t|%s %s\n", s.k, bar(s.add.Mean(), longest), round(s.add.Mean()))
+		fmt.Fprintf(tw, "\tDEL\t|%s %s\n", bar(s.del.Mean(), longest), round(s.del.Mean()))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// bar returns a bar of up to chartWidth characters for d relative to max.
+func bar(d, max time.Duration) string {
+	if max <= 0 || d <= 0 {
+		return ""
+	}
+	if d > max {
+		d = max
+	}
+	return strings.Repeat("#", int(float64(d)/float64(max)*chartWidth))
+}
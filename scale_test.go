@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBar(t *testing.T) {
+	testCases := []struct {
+		d, max   time.Duration
+		expected int
+	}{
+		{d: 10 * time.Millisecond, max: 10 * time.Millisecond, expected: chartWidth},
+		{d: 5 * time.Millisecond, max: 10 * time.Millisecond, expected: chartWidth / 2},
+		{d: 0, max: 10 * time.Millisecond, expected: 0},
+		// Nothing recorded at all.
+		{d: 0, max: 0, expected: 0},
+		{d: 10 * time.Millisecond, max: 0, expected: 0},
+		// Never wider than the chart.
+		{d: 20 * time.Millisecond, max: 10 * time.Millisecond, expected: chartWidth},
+		{d: -time.Millisecond, max: 10 * time.Millisecond, expected: 0},
+	}
+	for _, tc := range testCases {
+		got := bar(tc.d, tc.max)
+		if got != strings.Repeat("#", tc.expected) {
+			t.Errorf("bar(%s, %s): expected %d characters, got %q", tc.d, tc.max, tc.expected, got)
+		}
+	}
+}
+
+func TestPrintScale(t *testing.T) {
+	results := []*scaleResult{
+		{k: 0, add: newHistogram(), del: newHistogram()},
+		{k: 10, add: newHistogram(), del: newHistogram(), failures: 1},
+	}
+	for i := 0; i < 2; i++ {
+		results[0].add.Record(10 * time.Millisecond)
+		results[0].del.Record(5 * time.Millisecond)
+		results[1].add.Record(20 * time.Millisecond)
+		results[1].del.Record(10 * time.Millisecond)
+	}
+
+	var buf bytes.Buffer
+	if err := printScale(&buf, "fake", results); err != nil {
+		t.Fatal(err)
+	}
+	expected := `PLUGIN    ATTACHED   N         FAILED    ADD MEAN   ADD P50   ADD P99   DEL MEAN   DEL P50   DEL P99
+fake      0          2         0         10ms       10ms      10ms      5ms        5ms       5ms
+fake      10         2         1         20ms       20ms      20ms      10ms       10ms      10ms
+
+fake: mean latency of the next pod by number of attached pods
+0  ADD |` + strings.Repeat("#", 25) + ` 10ms
+   DEL |` + strings.Repeat("#", 12) + ` 5ms
+10 ADD |` + strings.Repeat("#", 50) + ` 20ms
+   DEL |` + strings.Repeat("#", 25) + ` 10ms
+
+`
+	if got := buf.String(); got != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	buf.Reset()
+	if err := printScale(&buf, "fake", nil); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected nothing without results, got %q", buf.String())
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// histogramSubBucketBits gives 2048 sub-buckets per power of two, so
+	// every recorded value is kept with three significant digits.
+	histogramSubBucketBits = 11
+	histogramSubBuckets    = 1 << histogramSubBucketBits
+	histogramHalfBuckets   = histogramSubBuckets / 2
+
+	// z95 is the z-score for a two-sided 95% confidence interval.
+	z95 = 1.96
+)
+
+// histogram is an HDR-style histogram of durations. Values below 2048ns are
+// recorded exactly, larger values are bucketed with a relative error of at
+// most 1/1024. Min, max, mean and standard deviation are tracked exactly.
+type histogram struct {
+	counts map[int]int64
+	n      int64
+	min    time.Duration
+	max    time.Duration
+	mean   float64
+	m2     float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: map[int]int64{}}
+}
+
+func histogramIndex(v int64) int {
+	if v < histogramSubBuckets {
+		return int(v)
+	}
+	shift := uint(bits.Len64(uint64(v)) - histogramSubBucketBits)
+	return int(shift)*histogramHalfBuckets + int(v>>shift)
+}
+
+// histogramValue returns the highest value that maps to the bucket at idx.
+func histogramValue(idx int) int64 {
+	if idx < histogramSubBuckets {
+		return int64(idx)
+	}
+	shift := uint(idx/histogramHalfBuckets - 1)
+	sub := int64(idx - int(shift)*histogramHalfBuckets)
+	return (sub+1)<<shift - 1
+}
+
+// Record adds a sample to the histogram.
+func (h *histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.counts[histogramIndex(int64(d))]++
+	h.n++
+	if h.n == 1 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+
+	// Welford's online algorithm for the mean and variance.
+	delta := float64(d) - h.mean
+	h.mean += delta / float64(h.n)
+	h.m2 += delta * (float64(d) - h.mean)
+}
+
+// Count returns the number of samples.
+func (h *histogram) Count() int64 {
+	return h.n
+}
+
+// Mean returns the arithmetic mean of the samples.
+func (h *histogram) Mean() time.Duration {
+	return time.Duration(h.mean)
+}
+
+// Stddev returns the sample standard deviation.
+func (h *histogram) Stddev() time.Duration {
+	if h.n < 2 {
+		return 0
+	}
+	return time.Duration(math.Sqrt(h.m2 / float64(h.n-1)))
+}
+
+// Percentile returns the value below which q percent of the samples fall.
+func (h *histogram) Percentile(q float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	idxs := make([]int, 0, len(h.counts))
+	for idx := range h.counts {
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+
+	want := int64(math.Ceil(q / 100 * float64(h.n)))
+	if want < 1 {
+		want = 1
+	}
+	var seen int64
+	for _, idx := range idxs {
+		seen += h.counts[idx]
+		if seen >= want {
+			v := time.Duration(histogramValue(idx))
+			// The bucket bound can be past the largest sample.
+			if v > h.max {
+				v = h.max
+			}
+			return v
+		}
+	}
+	return h.max
+}
+
+// RelativeCI returns the half-width of the 95% confidence interval of the
+// mean relative to the mean.
+func (h *histogram) RelativeCI() float64 {
+	if h.n < 2 || h.mean == 0 {
+		return math.Inf(1)
+	}
+	return z95 * float64(h.Stddev()) / math.Sqrt(float64(h.n)) / h.mean
+}
+
+// summary is a snapshot of the statistics of a histogram.
+type summary struct {
+	N      int64         `json:"n"`
+	Min    time.Duration `json:"min"`
+	Max    time.Duration `json:"max"`
+	Mean   time.Duration `json:"mean"`
+	Stddev time.Duration `json:"stddev"`
+	P50    time.Duration `json:"p50"`
+	P90    time.Duration `json:"p90"`
+	P99    time.Duration `json:"p99"`
+}
+
+// Summary returns the statistics of the histogram.
+func (h *histogram) Summary() summary {
+	return summary{
+		N:      h.n,
+		Min:    h.min,
+		Max:    h.max,
+		Mean:   h.Mean(),
+		Stddev: h.Stddev(),
+		P50:    h.Percentile(50),
+		P90:    h.Percentile(90),
+		P99:    h.Percentile(99),
+	}
+}
+
+// sampler decides how many iterations to run for a plugin.
+type sampler struct {
+	// iterations is the number of iterations to run, or the minimum number
+	// when converging.
+	iterations int
+	// converge is the target relative confidence interval half-width, zero
+	// disables convergence mode.
+	converge float64
+	// maxIterations bounds convergence mode.
+	maxIterations int
+}
+
+// done reports whether enough iterations ran.
+func (s sampler) done(ran int, hists ...*histogram) bool {
+	if ran < s.iterations {
+		return false
+	}
+	if s.converge <= 0 || ran >= s.maxIterations {
+		return true
+	}
+	for _, h := range hists {
+		// Give up if nothing succeeded, there is nothing to converge.
+		if h.Count() == 0 {
+			return true
+		}
+		if h.RelativeCI() > s.converge {
+			return false
+		}
+	}
+	return true
+}
+
+// pluginStats holds the ADD and DEL latencies of one plugin, and how long
+// creating and destroying the network namespace took.
+type pluginStats struct {
+	plugin   string
+	create   *histogram
+	add      *histogram
+	ready    *histogram
+	del      *histogram
+	destroy  *histogram
+	failures int
+	// skipped is why the plugin did not run.
+	skipped string
+
+	// leaks counts the iterations every leftover object was seen in.
+	leaks           map[string]int
+	leakyIterations int
+
+	addUsage usageTotals
+	delUsage usageTotals
+
+	podToPod  trafficTotals
+	podToHost trafficTotals
+}
+
+func newPluginStats(plugin string) *pluginStats {
+	return &pluginStats{
+		plugin:  plugin,
+		create:  newHistogram(),
+		add:     newHistogram(),
+		del:     newHistogram(),
+		destroy: newHistogram(),
+		ready:   newHistogram(),
+		leaks:   map[string]int{},
+	}
+}
+
+// record adds the ADD and DEL latencies of a run, failed runs are only
+// counted.
+func (s *pluginStats) record(r *record) {
+	if len(r.Leaks) > 0 {
+		s.leakyIterations++
+	}
+	for _, o := range r.Leaks {
+		s.leaks[o]++
+	}
+
+	if r.Error != "" {
+		s.failures++
+		return
+	}
+	s.create.Record(r.Timings.CreateNetNS)
+	s.add.Record(r.Timings.SetupNetNS)
+	s.del.Record(r.Timings.Remove)
+	s.destroy.Record(r.Timings.DestroyNetNS)
+	if r.Readiness != nil {
+		s.ready.Record(r.Readiness.FirstPacket)
+	}
+	if r.Usage != nil {
+		s.addUsage.record(r.Usage.Add, r.Usage.AddShimCPU, r.Timings.SetupNetNS)
+		s.delUsage.record(r.Usage.Del, r.Usage.DelShimCPU, r.Timings.Remove)
+	}
+	if r.DataPlane != nil {
+		s.podToPod.record(r.DataPlane.PodToPod)
+		s.podToHost.record(r.DataPlane.PodToHost)
+	}
+}
+
+// operation is a row of the statistics table.
+type operation struct {
+	name string
+	h    *histogram
+}
+
+// printStats writes a table with the ADD and DEL statistics of every plugin,
+// with the network namespace CREATE before and DESTROY after them. READY,
+// when probed, is from the start of ADD to the first packet.
+func printStats(w io.Writer, stats []*pluginStats) error {
+	tw := tabwriter.NewWriter(w, 10, 1, 3, ' ', 0)
+	fmt.Fprintln(tw, "PLUGIN\tOP\tN\tFAILED\tMIN\tMAX\tMEAN\tSTDDEV\tP50\tP90\tP99")
+	for _, s := range stats {
+		if s.skipped != "" {
+			fmt.Fprintf(tw, "%s\tSKIPPED\t%s\n", s.plugin, s.skipped)
+			continue
+		}
+		ops := []operation{{"CREATE", s.create}, {"ADD", s.add}}
+		if s.ready.Count() > 0 {
+			ops = append(ops, operation{"READY", s.ready})
+		}
+		ops = append(ops, operation{"DEL", s.del}, operation{"DESTROY", s.destroy})
+		for _, op := range ops {
+			sum := op.h.Summary()
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				s.plugin, op.name, sum.N, s.failures,
+				round(sum.Min), round(sum.Max), round(sum.Mean), round(sum.Stddev),
+				round(sum.P50), round(sum.P90), round(sum.P99))
+		}
+	}
+	return tw.Flush()
+}
+
+// round makes durations readable in tables.
+func round(d time.Duration) time.Duration {
+	switch {
+	case d > time.Second:
+		return d.Round(time.Millisecond)
+	case d > time.Millisecond:
+		return d.Round(time.Microsecond)
+	}
+	return d
+}
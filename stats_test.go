@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHistogramIndex(t *testing.T) {
+	prev := -1
+	for _, v := range []int64{0, 1, 2047, 2048, 2049, 4095, 4096, 1 << 20, 1<<20 + 1, 1 << 40} {
+		idx := histogramIndex(v)
+		if idx < prev {
+			t.Fatalf("index for %d (%d) is lower than the previous index (%d)", v, idx, prev)
+		}
+		prev = idx
+
+		upper := histogramValue(idx)
+		if upper < v {
+			t.Fatalf("bucket upper bound %d for %d is lower than the value", upper, v)
+		}
+		if rel := float64(upper-v) / float64(v+1); rel > 1.0/1024 {
+			t.Fatalf("relative error for %d is %f", v, rel)
+		}
+	}
+}
+
+func TestHistogramSummary(t *testing.T) {
+	h := newHistogram()
+	for i := 1; i <= 100; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+
+	s := h.Summary()
+	if s.N != 100 {
+		t.Fatalf("expected 100 samples, got %d", s.N)
+	}
+	if s.Min != time.Millisecond || s.Max != 100*time.Millisecond {
+		t.Fatalf("expected min 1ms and max 100ms, got %s and %s", s.Min, s.Max)
+	}
+	if s.Mean != 50500*time.Microsecond {
+		t.Fatalf("expected mean 50.5ms, got %s", s.Mean)
+	}
+	if math.Abs(float64(s.Stddev-29011*time.Microsecond)) > float64(time.Microsecond) {
+		t.Fatalf("expected stddev of about 29.011ms, got %s", s.Stddev)
+	}
+
+	for q, expected := range map[float64]time.Duration{
+		50: 50 * time.Millisecond,
+		90: 90 * time.Millisecond,
+		99: 99 * time.Millisecond,
+	} {
+		got := h.Percentile(q)
+		if math.Abs(float64(got-expected))/float64(expected) > 1.0/1024 {
+			t.Fatalf("expected p%v to be about %s, got %s", q, expected, got)
+		}
+	}
+}
+
+func TestSampler(t *testing.T) {
+	h := newHistogram()
+	s := sampler{iterations: 3}
+	if s.done(2, h) {
+		t.Fatal("expected sampler to want more iterations")
+	}
+	if !s.done(3, h) {
+		t.Fatal("expected sampler to be done")
+	}
+
+	s = sampler{iterations: 3, converge: 0.01, maxIterations: 100}
+	for _, v := range []time.Duration{10, 20, 30} {
+		h.Record(v * time.Millisecond)
+	}
+	if s.done(3, h) {
+		t.Fatal("expected sampler to keep going until the interval is narrow enough")
+	}
+	if !s.done(100, h) {
+		t.Fatal("expected sampler to stop at max iterations")
+	}
+	for i := 0; i < 1000; i++ {
+		h.Record(20 * time.Millisecond)
+	}
+	if !s.done(4, h) {
+		t.Fatalf("expected sampler to converge, relative CI is %f", h.RelativeCI())
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// maxSubnetMoves is how many subnets after the preferred one are tried
+// before giving up on finding a free one.
+const maxSubnetMoves = 4096
+
+// templateValues are the values set with -set, they win over the ones
+// detected on the host.
+type templateValues map[string]string
+
+func (v templateValues) String() string {
+	values := []string{}
+	for key, value := range v {
+		values = append(values, key+"="+value)
+	}
+	sort.Strings(values)
+	return strings.Join(values, ",")
+}
+
+func (v templateValues) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("%q must be key=value", s)
+	}
+	v[s[:i]] = s[i+1:]
+	return nil
+}
+
+// isTemplate reports whether a configuration is a template.
+func isTemplate(data []byte) bool {
+	return bytes.Contains(data, []byte("{{"))
+}
+
+// renderTemplates renders the configurations that are templates. They can
+// use the master the harness creates as {{.master}}, the MTU of the default
+// route, or of the master without one, as {{.mtu}}, any value set with
+// -set, and {{subnet "10.1.2.0/24"}} for that subnet or, if it overlaps a
+// host route or another configuration, the next free one of the same size.
+func (b *benchmarkCNI) renderTemplates(plugins []string) error {
+	templates := map[string][]byte{}
+	taken := []*net.IPNet{}
+	for _, plugin := range plugins {
+		data, err := ioutil.ReadFile(b.confFile(plugin))
+		if err != nil {
+			return fmt.Errorf("reading configuration of %s failed: %v", plugin, err)
+		}
+		if isTemplate(data) {
+			templates[plugin] = data
+			continue
+		}
+		subnets, err := confSubnets(data)
+		if err != nil {
+			return fmt.Errorf("parsing configuration of %s failed: %v", plugin, err)
+		}
+		taken = append(taken, subnets...)
+	}
+	if len(templates) == 0 {
+		return nil
+	}
+
+	routes, err := hostRoutes()
+	if err != nil {
+		return err
+	}
+	taken = append(taken, routes...)
+	needMTU := false
+	for _, data := range templates {
+		needMTU = needMTU || bytes.Contains(data, []byte(".mtu"))
+	}
+	values, err := templateData(needMTU)
+	if err != nil {
+		return err
+	}
+
+	for _, plugin := range plugins {
+		data, ok := templates[plugin]
+		if !ok {
+			continue
+		}
+		t, err := template.New(plugin).Option("missingkey=error").Funcs(template.FuncMap{
+			"subnet": func(preferred string) (string, error) {
+				sn, err := freeSubnet(preferred, taken)
+				if err != nil {
+					return "", err
+				}
+				taken = append(taken, sn)
+				return sn.String(), nil
+			},
+		}).Parse(string(data))
+		if err != nil {
+			return fmt.Errorf("parsing configuration template of %s failed: %v", plugin, err)
+		}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, values); err != nil {
+			return fmt.Errorf("rendering configuration template of %s failed: %v", plugin, err)
+		}
+		if err := b.writeRendered(plugin, filepath.Ext(b.confFile(plugin)), buf.Bytes()); err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{"plugin": plugin}).Debugf("rendered configuration template to %s", b.rendered[plugin])
+	}
+	return nil
+}
+
+// templateData returns the values the templates can use: the master the
+// harness creates and, if needMTU, the mtu of the default route, overridden
+// by the values set with -set. Rootless the master is the one
+// setupRootless created.
+func templateData(needMTU bool) (map[string]string, error) {
+	values := map[string]string{"master": masterLink}
+	if inRootlessNS() {
+		values["master"] = rootlessMasterLink
+	}
+	for key, value := range setValues {
+		values[key] = value
+	}
+	if _, ok := values["mtu"]; !ok && needMTU {
+		mtu, err := templateMTU(values["master"])
+		if err != nil {
+			return nil, err
+		}
+		values["mtu"] = strconv.Itoa(mtu)
+	}
+	return values, nil
+}
+
+// templateMTU returns the MTU of the default route or, on hosts without one,
+// the MTU of the master.
+func templateMTU(master string) (int, error) {
+	if link, err := defaultRouteLink(); err == nil {
+		return link.Attrs().MTU, nil
+	}
+	// The harness has yet to create its master, it gets the same MTU.
+	if master == masterLink {
+		return ethernetMTU, nil
+	}
+	link, err := netlink.LinkByName(master)
+	if err != nil {
+		return 0, fmt.Errorf("the host has no default route and no master %s, set the mtu of the configuration templates with -set", master)
+	}
+	return link.Attrs().MTU, nil
+}
+
+// defaultRouteLink returns the link of the IPv4 default route, or the IPv6
+// one on hosts without. Rootless it is the master setupRootless created.
+func defaultRouteLink() (netlink.Link, error) {
+	if inRootlessNS() {
+		return netlink.LinkByName(rootlessMasterLink)
+	}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteList(nil, family)
+		if err != nil {
+			return nil, fmt.Errorf("listing host routes failed: %v", err)
+		}
+		for _, route := range routes {
+			if route.Dst != nil || route.LinkIndex == 0 {
+				continue
+			}
+			link, err := netlink.LinkByIndex(route.LinkIndex)
+			if err != nil {
+				return nil, fmt.Errorf("getting link of the default route failed: %v", err)
+			}
+			return link, nil
+		}
+	}
+	return nil, fmt.Errorf("the host has no default route")
+}
+
+// hostRoutes returns the destinations of the host routes, other than the
+// default ones.
+func hostRoutes() ([]*net.IPNet, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("listing host routes failed: %v", err)
+	}
+	dsts := []*net.IPNet{}
+	for _, route := range routes {
+		if route.Dst == nil {
+			continue
+		}
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+			continue
+		}
+		dsts = append(dsts, route.Dst)
+	}
+	return dsts, nil
+}
+
+// confSubnets returns every subnet in a configuration.
+func confSubnets(data []byte) ([]*net.IPNet, error) {
+	var conf interface{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, err
+	}
+	subnets := []*net.IPNet{}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for key, value := range v {
+				if s, ok := value.(string); ok && key == "subnet" {
+					if _, sn, err := net.ParseCIDR(s); err == nil {
+						subnets = append(subnets, sn)
+					}
+					continue
+				}
+				walk(value)
+			}
+		case []interface{}:
+			for _, value := range v {
+				walk(value)
+			}
+		}
+	}
+	walk(conf)
+	return subnets, nil
+}
+
+// freeSubnet returns the preferred subnet if it overlaps none of the taken
+// ones, or else the first free one of the same size after it.
+func freeSubnet(preferred string, taken []*net.IPNet) (*net.IPNet, error) {
+	_, sn, err := net.ParseCIDR(preferred)
+	if err != nil {
+		return nil, fmt.Errorf("subnet %q is not a CIDR", preferred)
+	}
+	for i := 0; sn != nil && i < maxSubnetMoves; i++ {
+		free := true
+		for _, t := range taken {
+			if sn.Contains(t.IP) || t.Contains(sn.IP) {
+				free = false
+				break
+			}
+		}
+		if free {
+			return sn, nil
+		}
+		sn = nextSubnet(sn)
+	}
+	return nil, fmt.Errorf("no free subnet like %s", preferred)
+}
+
+// nextSubnet returns the subnet of the same size after sn, or nil past the
+// end of the address space.
+func nextSubnet(sn *net.IPNet) *net.IPNet {
+	ones, _ := sn.Mask.Size()
+	if ones == 0 {
+		return nil
+	}
+	ip := make(net.IP, len(sn.IP))
+	copy(ip, sn.IP)
+	i, carry := (ones-1)/8, 1<<uint(7-(ones-1)%8)
+	for ; i >= 0 && carry > 0; i-- {
+		sum := int(ip[i]) + carry
+		ip[i], carry = byte(sum), sum>>8
+	}
+	if carry > 0 {
+		return nil
+	}
+	return &net.IPNet{IP: ip, Mask: sn.Mask}
+}
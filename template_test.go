@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFreeSubnet(t *testing.T) {
+	taken := []*net.IPNet{}
+	for _, s := range []string{"10.1.2.0/24", "10.1.3.128/25", "10.0.0.0/23", "fd00:20:0:1::/64"} {
+		_, sn, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		taken = append(taken, sn)
+	}
+
+	testCases := []struct {
+		preferred string
+		expected  string
+	}{
+		{preferred: "10.1.1.0/24", expected: "10.1.1.0/24"},
+		{preferred: "10.1.2.0/24", expected: "10.1.4.0/24"},
+		{preferred: "10.0.0.0/16", expected: "10.2.0.0/16"},
+		{preferred: "10.0.1.0/24", expected: "10.0.2.0/24"},
+		{preferred: "fd00:20:0:1::/64", expected: "fd00:20:0:2::/64"},
+		{preferred: "20.0.0.0/24", expected: "20.0.0.0/24"},
+	}
+	for _, tc := range testCases {
+		sn, err := freeSubnet(tc.preferred, taken)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.preferred, err)
+		}
+		if sn.String() != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.preferred, tc.expected, sn)
+		}
+	}
+
+	if _, err := freeSubnet("0.0.0.0/0", taken); err == nil {
+		t.Fatal("expected no free subnet when everything overlaps")
+	}
+}
+
+func TestConfSubnets(t *testing.T) {
+	conf := `{"subnet": "10.99.0.0/16", "plugins": [{"ipam": {"ranges": [[{"subnet": "10.1.2.0/24"}], [{"subnet": "fd00::/64"}]]}}]}`
+	subnets, err := confSubnets([]byte(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subnets) != 3 {
+		t.Fatalf("expected 3 subnets, got %v", subnets)
+	}
+}
+
+func TestTemplateData(t *testing.T) {
+	defer func(v templateValues) { setValues = v }(setValues)
+
+	setValues = templateValues{"mtu": "9000", "master": "ens3"}
+	values, err := templateData(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["mtu"] != "9000" || values["master"] != "ens3" {
+		t.Fatalf("expected the values set with -set, got %v", values)
+	}
+
+	// Without a template using it, the mtu is not looked up at all.
+	setValues = templateValues{}
+	values, err = templateData(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := values["mtu"]; ok || values["master"] != masterLink {
+		t.Fatalf("expected only the master, got %v", values)
+	}
+}
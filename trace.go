@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+)
+
+const (
+	// traceFileEnv is the file the shims append their trace entries to.
+	traceFileEnv = "CNI_BENCHMARKS_TRACE_FILE"
+	// tracePathEnv holds the directories of the real plugin binaries.
+	tracePathEnv = "CNI_BENCHMARKS_TRACE_PATH"
+)
+
+// execTrace is one execution of a plugin binary.
+type execTrace struct {
+	Plugin      string `json:"plugin"`
+	Command     string `json:"command"`
+	ContainerID string `json:"containerID,omitempty"`
+	IfName      string `json:"ifName,omitempty"`
+	// PID is the plugin process, ParentPID is the process that executed
+	// it: either the harness or the plugin that delegated to it.
+	PID        int           `json:"pid"`
+	ParentPID  int           `json:"parentPID"`
+	Start      time.Time     `json:"start"`
+	Duration   time.Duration `json:"duration"`
+	ExitStatus int           `json:"exitStatus"`
+	// Usage is the usage of the plugin and the processes it waited for,
+	// ShimUsage the usage of the shim itself.
+	Usage     *resourceUsage `json:"usage,omitempty"`
+	ShimUsage *resourceUsage `json:"shimUsage,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// isShim reports whether this process was executed by libcni or a plugin in
+// place of a plugin binary. The harness itself never has CNI_COMMAND set.
+func isShim() bool {
+	return os.Getenv(traceFileEnv) != "" && os.Getenv("CNI_COMMAND") != ""
+}
+
+// runShim runs the real plugin binary with the same stdin, stdout, stderr
+// and environment, records the execution in the trace file and returns the
+// exit status of the plugin.
+func runShim() int {
+	name := filepath.Base(os.Args[0])
+	t := &execTrace{
+		Plugin:      name,
+		Command:     os.Getenv("CNI_COMMAND"),
+		ContainerID: os.Getenv("CNI_CONTAINERID"),
+		IfName:      os.Getenv("CNI_IFNAME"),
+		ParentPID:   os.Getppid(),
+		Start:       time.Now(),
+	}
+
+	status := 1
+	path, err := invoke.FindInPath(name, filepath.SplitList(os.Getenv(tracePathEnv)))
+	if err == nil {
+		cmd := exec.Command(path, os.Args[1:]...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err = cmd.Start(); err == nil {
+			t.PID = cmd.Process.Pid
+			err = cmd.Wait()
+			if cmd.ProcessState != nil {
+				status = cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
+				t.Usage = newResourceUsage(cmd.ProcessState)
+			}
+		}
+	}
+	t.Duration = time.Since(t.Start)
+	t.ExitStatus = status
+	if err != nil {
+		t.Error = err.Error()
+		if t.PID == 0 {
+			// The plugin never ran, return a CNI error so the caller
+			// knows why.
+			fmt.Fprintf(os.Stdout, `{"code":100,"msg":%q}`, "trace shim: "+err.Error())
+		}
+	}
+
+	t.ShimUsage = selfUsage()
+	if err := appendTrace(os.Getenv(traceFileEnv), t); err != nil {
+		fmt.Fprintf(os.Stderr, "trace shim: %v\n", err)
+	}
+	return status
+}
+
+// appendTrace appends an entry to the trace file. Every entry is a single
+// write to a file opened with O_APPEND, so entries from concurrent shims do
+// not interleave.
+func appendTrace(path string, t *execTrace) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("opening trace file %s failed: %v", path, err)
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// tracer sets up the shims and reads back the trace entries.
+type tracer struct {
+	dir  string
+	file string
+}
+
+// newTracer creates a directory with a shim for every plugin binary found in
+// pluginDirs. The shims are symlinks to this binary. libcni has to use the
+// returned directory as its only plugin directory so CNI_PATH points at the
+// shims as well and delegated plugins are traced too.
+func newTracer(pluginDirs []string) (*tracer, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("finding the cni-benchmarks binary failed: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "cni-benchmarks-trace")
+	if err != nil {
+		return nil, fmt.Errorf("creating trace directory failed: %v", err)
+	}
+	t := &tracer{dir: dir, file: filepath.Join(dir, "trace.json")}
+	// Start from an empty trace file, the offsets count from there.
+	if err := ioutil.WriteFile(t.file, nil, 0644); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("creating trace file failed: %v", err)
+	}
+
+	for _, pluginDir := range pluginDirs {
+		files, err := ioutil.ReadDir(pluginDir)
+		if err != nil {
+			// Plugin directories that do not exist are fine.
+			continue
+		}
+		for _, f := range files {
+			if f.IsDir() || f.Mode()&0111 == 0 {
+				continue
+			}
+			shim := filepath.Join(dir, f.Name())
+			if _, err := os.Lstat(shim); err == nil {
+				// The first directory wins, like invoke.FindInPath.
+				continue
+			}
+			if err := os.Symlink(self, shim); err != nil {
+				t.Close()
+				return nil, fmt.Errorf("creating trace shim for %s failed: %v", f.Name(), err)
+			}
+		}
+	}
+
+	// The plugins inherit our environment.
+	os.Setenv(traceFileEnv, t.file)
+	os.Setenv(tracePathEnv, strings.Join(pluginDirs, string(filepath.ListSeparator)))
+
+	return t, nil
+}
+
+// offset returns the current size of the trace file, entries written after
+// it belong to the next operation.
+func (t *tracer) offset() int64 {
+	fi, err := os.Stat(t.file)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// since returns the entries written after offset for the container, ordered
+// by start time.
+func (t *tracer) since(offset int64, containerID string) ([]*execTrace, error) {
+	f, err := os.Open(t.file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening trace file failed: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("seeking in trace file failed: %v", err)
+	}
+
+	entries := []*execTrace{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		e := &execTrace{}
+		if err := json.Unmarshal(s.Bytes(), e); err != nil {
+			return nil, fmt.Errorf("parsing trace entry failed: %v", err)
+		}
+		if e.ContainerID == containerID {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Start.Before(entries[j].Start)
+	})
+	return entries, s.Err()
+}
+
+// Close removes the shims and the trace file.
+func (t *tracer) Close() error {
+	os.Unsetenv(traceFileEnv)
+	os.Unsetenv(tracePathEnv)
+	return os.RemoveAll(t.dir)
+}
+
+// filterTrace returns the entries for a CNI command.
+func filterTrace(entries []*execTrace, command string) []*execTrace {
+	filtered := []*execTrace{}
+	for _, e := range entries {
+		if e.Command == command {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
+
+// printTrace writes the entries of one operation as a nested timeline. A
+// plugin is nested under the plugin that executed it.
+func printTrace(w io.Writer, title string, entries []*execTrace) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	byPID := map[int]*execTrace{}
+	for _, e := range entries {
+		byPID[e.PID] = e
+	}
+	depth := func(e *execTrace) int {
+		d := 0
+		for p, ok := byPID[e.ParentPID]; ok && d < len(entries); p, ok = byPID[p.ParentPID] {
+			d++
+		}
+		return d
+	}
+
+	fmt.Fprintln(w, title)
+	tw := tabwriter.NewWriter(w, 10, 1, 3, ' ', 0)
+	fmt.Fprintln(tw, "  START\tDURATION\tPLUGIN\tEXIT")
+	start := entries[0].Start
+	for _, e := range entries {
+		exit := fmt.Sprintf("%d", e.ExitStatus)
+		if e.Error != "" && e.PID == 0 {
+			exit = e.Error
+		}
+		fmt.Fprintf(tw, "  +%s\t%s\t%s%s\t%s\n",
+			round(e.Start.Sub(start)), round(e.Duration),
+			strings.Repeat("  ", depth(e)), e.Plugin, exit)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
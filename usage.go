@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// resourceUsage is what a plugin process and the processes it waited for
+// used, as reported by wait4.
+type resourceUsage struct {
+	UserCPU                time.Duration `json:"userCPU"`
+	SystemCPU              time.Duration `json:"systemCPU"`
+	MaxRSS                 int64         `json:"maxRSS"`
+	VoluntaryCtxSwitches   int64         `json:"voluntaryCtxSwitches"`
+	InvoluntaryCtxSwitches int64         `json:"involuntaryCtxSwitches"`
+	MinorFaults            int64         `json:"minorFaults"`
+	MajorFaults            int64         `json:"majorFaults"`
+}
+
+func newResourceUsage(ps *os.ProcessState) *resourceUsage {
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return nil
+	}
+	return rusageOf(ru)
+}
+
+// selfUsage returns the usage of the calling process, without its children.
+func selfUsage() *resourceUsage {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return nil
+	}
+	return rusageOf(&ru)
+}
+
+func rusageOf(ru *syscall.Rusage) *resourceUsage {
+	return &resourceUsage{
+		UserCPU:   time.Duration(ru.Utime.Nano()),
+		SystemCPU: time.Duration(ru.Stime.Nano()),
+		// Linux reports kilobytes.
+		MaxRSS:                 ru.Maxrss * 1024,
+		VoluntaryCtxSwitches:   ru.Nvcsw,
+		InvoluntaryCtxSwitches: ru.Nivcsw,
+		MinorFaults:            ru.Minflt,
+		MajorFaults:            ru.Majflt,
+	}
+}
+
+// add sums the counters of o into u, MaxRSS is the larger of the two.
+func (u *resourceUsage) add(o *resourceUsage) {
+	u.UserCPU += o.UserCPU
+	u.SystemCPU += o.SystemCPU
+	if o.MaxRSS > u.MaxRSS {
+		u.MaxRSS = o.MaxRSS
+	}
+	u.VoluntaryCtxSwitches += o.VoluntaryCtxSwitches
+	u.InvoluntaryCtxSwitches += o.InvoluntaryCtxSwitches
+	u.MinorFaults += o.MinorFaults
+	u.MajorFaults += o.MajorFaults
+}
+
+// sub removes the counters of o from u, MaxRSS is left alone since the peak
+// of o cannot be told apart.
+func (u *resourceUsage) sub(o *resourceUsage) {
+	u.UserCPU -= o.UserCPU
+	u.SystemCPU -= o.SystemCPU
+	u.VoluntaryCtxSwitches -= o.VoluntaryCtxSwitches
+	u.InvoluntaryCtxSwitches -= o.InvoluntaryCtxSwitches
+	u.MinorFaults -= o.MinorFaults
+	u.MajorFaults -= o.MajorFaults
+}
+
+// cpu returns the user and system CPU time.
+func (u *resourceUsage) cpu() time.Duration {
+	return u.UserCPU + u.SystemCPU
+}
+
+// operationUsage is the resource usage of the plugins run for ADD and DEL.
+// The CPU time of the trace shims is kept apart, it is not part of the usage
+// of the plugins but it is part of their latency.
+type operationUsage struct {
+	Add        *resourceUsage `json:"add,omitempty"`
+	Del        *resourceUsage `json:"del,omitempty"`
+	AddShimCPU time.Duration  `json:"addShimCPU,omitempty"`
+	DelShimCPU time.Duration  `json:"delShimCPU,omitempty"`
+}
+
+// newOperationUsage sums the usage of the plugins the harness executed
+// directly for ADD and DEL. Delegated plugins are already included in the
+// usage of the plugin that waited for them, and so is the shim in front of
+// them, which is taken out again.
+func newOperationUsage(entries []*execTrace) *operationUsage {
+	pids := map[int]bool{}
+	for _, e := range entries {
+		pids[e.PID] = true
+	}
+
+	u := &operationUsage{}
+	for _, e := range entries {
+		if e.Usage == nil && e.ShimUsage == nil {
+			continue
+		}
+		op, shimCPU := &u.Add, &u.AddShimCPU
+		if e.Command == "DEL" {
+			op, shimCPU = &u.Del, &u.DelShimCPU
+		}
+		if *op == nil {
+			*op = &resourceUsage{}
+		}
+		if e.ShimUsage != nil {
+			*shimCPU += e.ShimUsage.cpu()
+		}
+		if !pids[e.ParentPID] {
+			if e.Usage != nil {
+				(*op).add(e.Usage)
+			}
+		} else if e.ShimUsage != nil {
+			(*op).sub(e.ShimUsage)
+		}
+	}
+	if u.Add == nil && u.Del == nil {
+		return nil
+	}
+	return u
+}
+
+// usageTotals sums the resource usage of the successful runs of one
+// operation.
+type usageTotals struct {
+	n       int
+	total   resourceUsage
+	shimCPU time.Duration
+	wall    time.Duration
+}
+
+func (t *usageTotals) record(u *resourceUsage, shimCPU, wall time.Duration) {
+	if u == nil {
+		return
+	}
+	t.n++
+	t.total.add(u)
+	t.shimCPU += shimCPU
+	t.wall += wall
+}
+
+// printUsage writes a table with the mean resource usage of ADD and DEL for
+// every plugin. MAXRSS is the largest seen. CPU/WALL is how much of the
+// latency was spent on CPU, a low value means the plugin mostly waited, on a
+// daemon for example. SHIM is the CPU time of the trace shims, it is not in
+// the other columns but it is in the latency.
+func printUsage(w io.Writer, stats []*pluginStats) error {
+	tw := tabwriter.NewWriter(w, 10, 1, 3, ' ', 0)
+	fmt.Fprintln(tw, "PLUGIN\tOP\tN\tUSER\tSYS\tCPU/WALL\tMAXRSS\tVCSW\tIVCSW\tMINFLT\tMAJFLT\tSHIM")
+	for _, s := range stats {
+		for _, op := range []struct {
+			name string
+			t    *usageTotals
+		}{{"ADD", &s.addUsage}, {"DEL", &s.delUsage}} {
+			if op.t.n == 0 {
+				fmt.Fprintf(tw, "%s\t%s\t0\t\t\t\t\t\t\t\t\t\n", s.plugin, op.name)
+				continue
+			}
+			n := int64(op.t.n)
+			u := op.t.total
+			var ratio float64
+			if op.t.wall > 0 {
+				ratio = float64(u.cpu()) / float64(op.t.wall) * 100
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%.0f%%\t%s\t%d\t%d\t%d\t%d\t%s\n",
+				s.plugin, op.name, n,
+				round(u.UserCPU/time.Duration(n)), round(u.SystemCPU/time.Duration(n)), ratio,
+				formatBytes(u.MaxRSS),
+				u.VoluntaryCtxSwitches/n, u.InvoluntaryCtxSwitches/n,
+				u.MinorFaults/n, u.MajorFaults/n,
+				round(op.t.shimCPU/time.Duration(n)))
+		}
+	}
+	return tw.Flush()
+}
+
+// formatBytes returns b in the largest unit that keeps it above 1.
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
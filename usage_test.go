@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOperationUsage(t *testing.T) {
+	entries := []*execTrace{
+		{Plugin: "loopback", Command: "ADD", PID: 10, ParentPID: 1, Usage: &resourceUsage{UserCPU: time.Millisecond, MaxRSS: 4096, MinorFaults: 10}},
+		// flannel waited for the shim of bridge, so its usage includes the
+		// 2ms and 5 faults of that shim.
+		{Plugin: "flannel", Command: "ADD", PID: 11, ParentPID: 1, Usage: &resourceUsage{UserCPU: 7 * time.Millisecond, MaxRSS: 8192, MinorFaults: 35}, ShimUsage: &resourceUsage{UserCPU: time.Millisecond}},
+		// Delegated by flannel, already part of its usage.
+		{Plugin: "bridge", Command: "ADD", PID: 12, ParentPID: 11, Usage: &resourceUsage{UserCPU: 3 * time.Millisecond, MaxRSS: 8192, MinorFaults: 20}, ShimUsage: &resourceUsage{UserCPU: 2 * time.Millisecond, MinorFaults: 5}},
+		{Plugin: "flannel", Command: "DEL", PID: 13, ParentPID: 1, Usage: &resourceUsage{SystemCPU: 2 * time.Millisecond, MaxRSS: 2048}},
+	}
+
+	u := newOperationUsage(entries)
+	if u == nil || u.Add == nil || u.Del == nil {
+		t.Fatalf("expected ADD and DEL usage, got %#v", u)
+	}
+	if u.Add.UserCPU != 6*time.Millisecond || u.Add.MinorFaults != 40 || u.Add.MaxRSS != 8192 {
+		t.Fatalf("expected the ADD usage of loopback and flannel, got %#v", u.Add)
+	}
+	if u.AddShimCPU != 3*time.Millisecond || u.DelShimCPU != 0 {
+		t.Fatalf("expected 3ms of shim CPU for ADD, got %s and %s for DEL", u.AddShimCPU, u.DelShimCPU)
+	}
+	if u.Del.cpu() != 2*time.Millisecond || u.Del.MaxRSS != 2048 {
+		t.Fatalf("expected the DEL usage of flannel, got %#v", u.Del)
+	}
+
+	if u := newOperationUsage(nil); u != nil {
+		t.Fatalf("expected no usage without entries, got %#v", u)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for b, expected := range map[int64]string{
+		512:             "512B",
+		2048:            "2.0KiB",
+		5 * 1024 * 1024: "5.0MiB",
+	} {
+		if got := formatBytes(b); got != expected {
+			t.Fatalf("expected %s for %d, got %s", expected, b, got)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	cni "github.com/containerd/go-cni"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// validateResult compares what the CNI result claims with the links,
+// addresses and routes on the host and in the pod, and returns every
+// mismatch. It always returns to the original namespace.
+func (b *benchmarkCNI) validateResult(p *pod, result *cni.CNIResult) ([]string, error) {
+	defaultInterface := cni.DefaultPrefix + "0"
+	names := []string{}
+	for name := range result.Interfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mismatches := []string{}
+	// Interfaces without a sandbox are on the host. The default interface
+	// is in the pod even when the plugin did not report it.
+	for _, name := range names {
+		iface := result.Interfaces[name]
+		if iface.Sandbox != "" || name == defaultInterface {
+			continue
+		}
+		if _, err := validateInterface(name, iface); err != nil {
+			mismatches = append(mismatches, "host "+err.Error())
+		}
+	}
+
+	if err := p.setNS(); err != nil {
+		return nil, err
+	}
+	defer netns.Set(b.originalNS)
+
+	for _, name := range names {
+		iface := result.Interfaces[name]
+		if iface.Sandbox == "" && name != defaultInterface {
+			continue
+		}
+		if iface.Sandbox != "" && iface.Sandbox != p.netnsFD {
+			mismatches = append(mismatches, fmt.Sprintf("%s: sandbox is %s, expected %s", name, iface.Sandbox, p.netnsFD))
+		}
+		link, err := validateInterface(name, iface)
+		if err != nil {
+			mismatches = append(mismatches, err.Error())
+			continue
+		}
+		mismatches = append(mismatches, validateIPs(link, iface.IPConfigs)...)
+	}
+
+	// Listed per family, netlink has no destination for the default route
+	// of either.
+	routes := map[string][]netlink.Route{}
+	for _, family := range families {
+		list, err := netlink.RouteList(nil, netlinkFamily(family))
+		if err != nil {
+			return nil, fmt.Errorf("listing routes in netns failed: %v", err)
+		}
+		routes[family] = list
+	}
+	for _, want := range result.Routes {
+		if !hasRoute(routes[ipFamily(want.Dst.IP)], want) {
+			mismatches = append(mismatches, fmt.Sprintf("route %s is missing", &want.Dst))
+		}
+	}
+
+	if err := netns.Set(b.originalNS); err != nil {
+		return nil, fmt.Errorf("returning to original namespace failed: %v", err)
+	}
+	return mismatches, nil
+}
+
+// validateInterface looks up the link of an interface in the current
+// namespace and checks its MAC.
+func validateInterface(name string, iface *cni.Config) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: no such link", name)
+	}
+	if iface.Mac == "" {
+		return link, nil
+	}
+	mac, err := net.ParseMAC(iface.Mac)
+	if err != nil {
+		return link, fmt.Errorf("%s: invalid mac %q", name, iface.Mac)
+	}
+	if got := link.Attrs().HardwareAddr; got.String() != mac.String() {
+		return link, fmt.Errorf("%s: mac is %s, result says %s", name, got, mac)
+	}
+	return link, nil
+}
+
+// validateIPs checks every IP is configured on the link and every gateway is
+// reached through it.
+func validateIPs(link netlink.Link, ipConfigs []*cni.IPConfig) []string {
+	name := link.Attrs().Name
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: listing addresses failed: %v", name, err)}
+	}
+
+	mismatches := []string{}
+	for _, c := range ipConfigs {
+		if !hasAddr(addrs, c.IP) {
+			mismatches = append(mismatches, fmt.Sprintf("%s: address %s is not configured", name, c.IP))
+		}
+		if c.Gateway == nil {
+			continue
+		}
+		routes, err := netlink.RouteGet(c.Gateway)
+		if err != nil || len(routes) == 0 {
+			mismatches = append(mismatches, fmt.Sprintf("%s: gateway %s is unreachable", name, c.Gateway))
+			continue
+		}
+		if routes[0].LinkIndex != link.Attrs().Index {
+			mismatches = append(mismatches, fmt.Sprintf("%s: gateway %s is not reached through it", name, c.Gateway))
+		}
+	}
+	return mismatches
+}
+
+// hasAddr reports whether ip is one of the addresses.
+func hasAddr(addrs []netlink.Addr, ip net.IP) bool {
+	for _, a := range addrs {
+		if a.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRoute reports whether one of the routes has the destination of want,
+// and its gateway if it has one. The routes must be of the family of want.
+func hasRoute(routes []netlink.Route, want *types.Route) bool {
+	for _, r := range routes {
+		if !sameDst(r.Dst, want.Dst) {
+			continue
+		}
+		if want.GW == nil || want.GW.Equal(r.Gw) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameDst compares route destinations of the same family, netlink has no
+// destination for the default routes.
+func sameDst(got *net.IPNet, want net.IPNet) bool {
+	if got == nil {
+		ones, _ := want.Mask.Size()
+		return ones == 0 && want.IP != nil
+	}
+	return got.String() == want.String()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	cni "github.com/containerd/go-cni"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+func TestHasRoute(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.10.0.0/16")
+	_, subnet6, _ := net.ParseCIDR("fd00::/64")
+	dualStack := map[string][]netlink.Route{
+		familyV4: {{Dst: nil, Gw: net.ParseIP("10.10.0.1")}, {Dst: subnet}},
+		familyV6: {{Dst: subnet6}},
+	}
+	// A default route through a device has neither a gateway nor a source
+	// to tell its family by.
+	v6Only := map[string][]netlink.Route{
+		familyV6: {{Dst: nil, LinkIndex: 2}},
+	}
+
+	testCases := []struct {
+		routes   map[string][]netlink.Route
+		route    string
+		gw       string
+		expected bool
+	}{
+		{routes: dualStack, route: "0.0.0.0/0", expected: true},
+		{routes: dualStack, route: "0.0.0.0/0", gw: "10.10.0.1", expected: true},
+		{routes: dualStack, route: "0.0.0.0/0", gw: "10.10.0.254", expected: false},
+		{routes: dualStack, route: "10.10.0.0/16", expected: true},
+		{routes: dualStack, route: "10.20.0.0/16", expected: false},
+		{routes: dualStack, route: "::/0", expected: false},
+		{routes: dualStack, route: "fd00::/64", expected: true},
+		{routes: v6Only, route: "::/0", expected: true},
+		{routes: v6Only, route: "0.0.0.0/0", expected: false},
+	}
+	for _, tc := range testCases {
+		_, dst, _ := net.ParseCIDR(tc.route)
+		want := &types.Route{Dst: *dst, GW: net.ParseIP(tc.gw)}
+		if got := hasRoute(tc.routes[ipFamily(dst.IP)], want); got != tc.expected {
+			t.Errorf("hasRoute(%s via %q): expected %t, got %t", tc.route, tc.gw, tc.expected, got)
+		}
+	}
+}
+
+func TestValidateResult(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating a network namespace needs root")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	originalNS, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer originalNS.Close()
+	b := &benchmarkCNI{originalNS: originalNS}
+
+	p, err := (&namedProvider{}).newPod()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// What a plugin would have done: eth0 with an address and an IPv4
+	// default route, nothing for IPv6. 10.30.0.0/24 is reached through the
+	// other end of the veth pair.
+	mac, _ := net.ParseMAC("0a:58:0a:0a:00:02")
+	if err := p.setNS(); err != nil {
+		t.Fatal(err)
+	}
+	err = func() error {
+		defer netns.Set(originalNS)
+		if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth0", HardwareAddr: mac}, PeerName: "peer0"}); err != nil {
+			return err
+		}
+		links := map[string]netlink.Link{}
+		for _, name := range []string{"eth0", "peer0"} {
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				return err
+			}
+			if err := netlink.LinkSetUp(link); err != nil {
+				return err
+			}
+			links[name] = link
+		}
+		addr, _ := netlink.ParseAddr("10.10.0.2/24")
+		if err := netlink.AddrAdd(links["eth0"], addr); err != nil {
+			return err
+		}
+		if err := netlink.RouteAdd(&netlink.Route{LinkIndex: links["eth0"].Attrs().Index, Gw: net.ParseIP("10.10.0.1")}); err != nil {
+			return err
+		}
+		_, other, _ := net.ParseCIDR("10.30.0.0/24")
+		return netlink.RouteAdd(&netlink.Route{LinkIndex: links["peer0"].Attrs().Index, Dst: other})
+	}()
+	if err != nil {
+		t.Fatalf("setting up the pod failed: %v", err)
+	}
+
+	_, defaultV4, _ := net.ParseCIDR("0.0.0.0/0")
+	_, defaultV6, _ := net.ParseCIDR("::/0")
+	result := &cni.CNIResult{
+		Interfaces: map[string]*cni.Config{
+			"eth0": {
+				Mac:     mac.String(),
+				Sandbox: p.netnsFD,
+				IPConfigs: []*cni.IPConfig{
+					{IP: net.ParseIP("10.10.0.2"), Gateway: net.ParseIP("10.10.0.1")},
+				},
+			},
+		},
+		Routes: []*types.Route{{Dst: *defaultV4, GW: net.ParseIP("10.10.0.1")}},
+	}
+	mismatches, err := b.validateResult(p, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("expected no mismatches, got %v", mismatches)
+	}
+
+	result.Interfaces["eth0"].IPConfigs = append(result.Interfaces["eth0"].IPConfigs,
+		&cni.IPConfig{IP: net.ParseIP("10.10.0.3")},
+		&cni.IPConfig{IP: net.ParseIP("10.10.0.2"), Gateway: net.ParseIP("10.30.0.1")},
+	)
+	result.Interfaces["cnibench-gone"] = &cni.Config{}
+	result.Routes = append(result.Routes, &types.Route{Dst: *defaultV6})
+	mismatches, err = b.validateResult(p, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"host cnibench-gone: no such link",
+		"eth0: address 10.10.0.3 is not configured",
+		"eth0: gateway 10.30.0.1 is not reached through it",
+		"route ::/0 is missing",
+	}
+	if got := strings.Join(mismatches, "\n"); got != strings.Join(expected, "\n") {
+		t.Fatalf("expected mismatches:\n%s\ngot:\n%s", strings.Join(expected, "\n"), got)
+	}
+
+	result.Interfaces["eth0"].Mac = "0a:58:0a:0a:00:03"
+	mismatches, err = b.validateResult(p, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "eth0: mac is 0a:58:0a:0a:00:02, result says 0a:58:0a:0a:00:03"; len(mismatches) < 2 || mismatches[1] != expected {
+		t.Fatalf("expected %q, got %v", expected, mismatches)
+	}
+}
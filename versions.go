@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/sirupsen/logrus"
+)
+
+// versionStats are the results of a plugin at one cniVersion.
+type versionStats struct {
+	version  string
+	add      *histogram
+	del      *histogram
+	failures int
+	// shapes counts the results by what they contained.
+	shapes map[string]int
+}
+
+// runVersions runs every plugin at each cniVersion all the plugins in its
+// configuration support, as reported by VERSION.
+func (b *benchmarkCNI) runVersions(plugins []string, write func(*record), w io.Writer) error {
+	b.doLog = debug
+
+	for _, plugin := range plugins {
+		versions, err := b.supportedVersions(plugin)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"plugin": plugin}).Error(err)
+			continue
+		}
+		logrus.WithFields(logrus.Fields{"plugin": plugin}).Infof("supported cniVersions: %s", strings.Join(versions, ", "))
+
+		// Every version is rendered from the configuration as it was.
+		base, rendered := b.rendered[plugin]
+		results := []*versionStats{}
+		for _, version := range versions {
+			version := version
+			if err := b.render(plugin, func(conf map[string]interface{}) error {
+				conf["cniVersion"] = version
+				return nil
+			}); err != nil {
+				logrus.WithFields(logrus.Fields{"plugin": plugin, "cniVersion": version}).Error(err)
+				continue
+			}
+			results = append(results, b.versionRuns(plugin, version, write))
+			if rendered {
+				b.rendered[plugin] = base
+			} else {
+				delete(b.rendered, plugin)
+			}
+		}
+
+		if err := printVersions(w, plugin, results); err != nil {
+			return fmt.Errorf("printing cniVersion results failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// versionRuns runs a plugin with its configuration rendered for version.
+func (b *benchmarkCNI) versionRuns(plugin, version string, write func(*record)) *versionStats {
+	logrus.WithFields(logrus.Fields{"plugin": plugin, "cniVersion": version}).Info("measuring cniVersion")
+	s := &versionStats{version: version, add: newHistogram(), del: newHistogram(), shapes: map[string]int{}}
+	for i := 0; i < iterations; i++ {
+		r := b.createNetwork(plugin, i)
+		r.CNIVersion = version
+		if r.Error != "" {
+			s.failures++
+			logrus.WithFields(logrus.Fields{"plugin": plugin, "cniVersion": version, "iteration": i}).Error(r.Error)
+		} else {
+			s.add.Record(r.Timings.SetupNetNS)
+			s.del.Record(r.Timings.Remove)
+		}
+		if r.Result != nil {
+			s.shapes[resultShape(r.Result)]++
+		}
+		write(r)
+	}
+	return s
+}
+
+// supportedVersions returns the cniVersions every plugin the configuration
+// of a plugin executes supports, including the IPAM and delegate plugins,
+// oldest first.
+func (b *benchmarkCNI) supportedVersions(plugin string) ([]string, error) {
+	list, err := b.confList(plugin)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &libcni.CNIConfig{Path: b.pluginDirs}
+	supported := [][]string{}
+	seen := map[string]bool{}
+	for _, conf := range list.Plugins {
+		raw := map[string]interface{}{}
+		if err := json.Unmarshal(conf.Bytes, &raw); err != nil {
+			return nil, fmt.Errorf("decoding configuration of %s failed: %v", plugin, err)
+		}
+		for _, t := range executedTypes(raw) {
+			if seen[t] {
+				continue
+			}
+			seen[t] = true
+			info, err := c.GetVersionInfo(t)
+			if err != nil {
+				return nil, fmt.Errorf("getting the versions %s supports failed: %v", t, err)
+			}
+			supported = append(supported, info.SupportedVersions())
+		}
+	}
+
+	versions := commonVersions(supported)
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("the plugins in the configuration have no cniVersion in common")
+	}
+	return versions, nil
+}
+
+// commonVersions returns the versions in every one of the lists, oldest
+// first. Plugins list some versions twice and portmap an empty one.
+func commonVersions(supported [][]string) []string {
+	counts := map[string]int{}
+	for _, list := range supported {
+		seen := map[string]bool{}
+		for _, v := range list {
+			if v == "" || seen[v] {
+				continue
+			}
+			seen[v] = true
+			counts[v]++
+		}
+	}
+
+	versions := []string{}
+	for v, n := range counts {
+		if n == len(supported) {
+			versions = append(versions, v)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versionLess(versions[i], versions[j])
+	})
+	return versions
+}
+
+// versionLess compares dotted version numbers.
+func versionLess(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.Atoi(as[i])
+		y, _ := strconv.Atoi(bs[i])
+		if x != y {
+			return x < y
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// resultShape summarizes what a result contained: the interfaces the
+// plugins reported, the IPs, gateways and routes.
+func resultShape(r *cniResult) string {
+	interfaces, ips, gateways := 0, 0, 0
+	for _, iface := range r.Interfaces {
+		if iface.Mac != "" || iface.Sandbox != "" {
+			interfaces++
+		}
+		ips += len(iface.IPs)
+		gateways += len(iface.Gateway)
+	}
+	return fmt.Sprintf("interfaces=%d ips=%d gateways=%d routes=%d", interfaces, ips, gateways, len(r.Routes))
+}
+
+// printVersions prints the ADD and DEL cost of every cniVersion relative to
+// the oldest one, and the shapes of the results.
+func printVersions(w io.Writer, plugin string, results []*versionStats) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 10, 1, 3, ' ', 0)
+	fmt.Fprintln(tw, "PLUGIN\tCNIVERSION\tN\tFAILED\tADD MEAN\tADD COST\tDEL MEAN\tDEL COST\tRESULT")
+	base := results[0]
+	for _, s := range results {
+		shapes := []string{}
+		for shape, n := range s.shapes {
+			if len(s.shapes) > 1 {
+				shape += fmt.Sprintf(" (%d)", n)
+			}
+			shapes = append(shapes, shape)
+		}
+		sort.Strings(shapes)
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			plugin, s.version, s.add.Count(), s.failures,
+			round(s.add.Mean()), cost(s.add.Mean()-base.add.Mean()),
+			round(s.del.Mean()), cost(s.del.Mean()-base.del.Mean()),
+			strings.Join(shapes, "; "))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
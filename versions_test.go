@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestVersionLess(t *testing.T) {
+	versions := []string{"0.4.0", "0.10.0", "0.3.1", "0.1.0", "0.3.0", "1.0.0"}
+	sort.Slice(versions, func(i, j int) bool {
+		return versionLess(versions[i], versions[j])
+	})
+	expected := "0.1.0 0.3.0 0.3.1 0.4.0 0.10.0 1.0.0"
+	if got := strings.Join(versions, " "); got != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestCommonVersions(t *testing.T) {
+	testCases := []struct {
+		supported [][]string
+		expected  string
+	}{
+		{
+			// bin/bandwidth lists 0.3.1 twice.
+			supported: [][]string{{"0.1.0", "0.2.0", "0.3.0", "0.3.1"}, {"0.3.0", "0.3.1", "0.3.1"}},
+			expected:  "0.3.0 0.3.1",
+		},
+		{
+			// bin/portmap lists an empty version.
+			supported: [][]string{{"0.3.0", "0.3.1"}, {"", "0.3.0", "0.3.1"}},
+			expected:  "0.3.0 0.3.1",
+		},
+		{
+			supported: [][]string{{"0.1.0", "0.1.0"}, {"0.2.0"}},
+			expected:  "",
+		},
+	}
+	for _, tc := range testCases {
+		if got := strings.Join(commonVersions(tc.supported), " "); got != tc.expected {
+			t.Errorf("%v: expected %q, got %q", tc.supported, tc.expected, got)
+		}
+	}
+}
+
+func TestResultShape(t *testing.T) {
+	r := &cniResult{
+		Interfaces: []cniInterface{
+			{Name: "eth0", Mac: "0a:58:0a:0a:00:02", Sandbox: "/proc/1/ns/net", IPs: []string{"10.10.0.2", "fd00::2"}, Gateway: []string{"10.10.0.1"}},
+			{Name: "veth1234", Mac: "0a:58:0a:0a:00:01"},
+			{Name: "lo"},
+		},
+		Routes: []string{"0.0.0.0/0"},
+	}
+	expected := "interfaces=2 ips=2 gateways=1 routes=1"
+	if got := resultShape(r); got != expected {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+}